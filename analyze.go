@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// apiCallsRemaining is what is left of the MAX_API_CALLS budget shared by all
+// regions, or -1 if there is no budget.
+var apiCallsRemaining atomic.Int64
+
+// takeAPICall reserves one call from the budget, reporting false if it is
+// exhausted.
+func takeAPICall() bool {
+	for {
+		n := apiCallsRemaining.Load()
+		if n < 0 {
+			return true
+		} else if n == 0 {
+			return false
+		}
+		if apiCallsRemaining.CompareAndSwap(n, n-1) {
+			return true
+		}
+	}
+}
+
+// refundAPICall returns a call reserved with takeAPICall that wasn't made.
+func refundAPICall() {
+	for {
+		n := apiCallsRemaining.Load()
+		if n < 0 || apiCallsRemaining.CompareAndSwap(n, n+1) {
+			return
+		}
+	}
+}
+
+// analysisResult is the analysis of a single manifest entry, either read from
+// the cache or freshly requested (in which case Requested is
+// set). If the request failed Err is set and Analysis is empty. If the entry
+// had no cached analysis and requests were disabled Uncached is set and
+// Analysis is empty. If the entry was skipped without being looked up, for
+// example because of its owner, Skip explains why and Analysis is empty.
+type analysisResult struct {
+	Picture     selector.ManifestEntry
+	Analysis    selector.ImageAnalysis
+	Provider    string
+	AnalyzedURL string
+	PHash       string
+	Location    *PhotoLocation
+	Date        *PhotoDate
+	Text        *selector.TextAnalysis
+	Secondary   *SecondaryAnalysis
+	Requested   bool
+	Uncached    bool
+	Skip        string
+	Err         error
+}
+
+// analyzeEntries looks up or requests the analysis of each entry in the
+// manifest of region, fanning the uncached requests out across up to concurrency workers. If
+// request is false, or the API call budget is exhausted, no requests are made
+// and uncached entries are reported as such.
+//
+// Results are delivered in manifest order so that callers can stop as soon as
+// they have seen enough. Closing stop prevents any further requests from being
+// started; results already in flight are still delivered before the returned
+// channel is closed. Cancelling ctx aborts the requests in flight.
+func analyzeEntries(ctx context.Context, region string, manifest manifestSource, cache AnalysisCache, concurrency int, request bool, stop <-chan struct{}) <-chan analysisResult {
+	// pending holds the result of each entry in order. Its capacity bounds how
+	// far ahead of the consumer the workers can get.
+	pending := make(chan chan analysisResult, concurrency)
+	sem := make(chan struct{}, concurrency)
+
+	go func() {
+		defer close(pending)
+		err := manifest(func(entry selector.ManifestEntry) bool {
+			resultC := make(chan analysisResult, 1)
+			skip := ownerSkipReason(entry.Owner)
+			existing, ok := cache.Get(entry.ID)
+			if ok && ((existing.Failure != nil && retryFailed) || forceReanalysis(entry.ID)) {
+				ok = false
+			}
+			// The preview size or source may have changed since the analysis.
+			if ok && reanalyzeChangedURL && existing.AnalyzedURL != "" && !sameImageURL(entry, existing.AnalyzedURL, flickrImagePreviewURL(entry)) {
+				ok = false
+			}
+			if skip != "" {
+				resultC <- analysisResult{Picture: entry, Skip: skip}
+			} else if ok && existing.Failure != nil {
+				err := &selector.PermanentError{Err: fmt.Errorf("previously failed at %s: %s",
+					existing.Failure.Time.Format(time.RFC3339), existing.Failure.Reason)}
+				resultC <- analysisResult{Picture: existing.Picture, Err: err}
+			} else if ok {
+				resultC <- analysisResult{Picture: existing.Picture, Analysis: existing.Analysis, Provider: existing.Provider, AnalyzedURL: existing.AnalyzedURL, PHash: existing.PHash, Location: existing.Location, Date: existing.Date, Text: existing.Text, Secondary: existing.Secondary}
+			} else if !request || !takeAPICall() {
+				resultC <- analysisResult{Picture: entry, Uncached: true}
+			} else {
+				select {
+				case sem <- struct{}{}:
+				case <-stop:
+					return false
+				}
+				go func(entry selector.ManifestEntry) {
+					defer func() { <-sem }()
+					imageURL := flickrImagePreviewURL(entry)
+					if err := checkPreviewAvailable(entry); err != nil {
+						refundAPICall()
+						resultC <- analysisResult{Picture: entry, Requested: true, Err: &selector.PermanentError{Err: err}}
+						return
+					}
+					analysis, err := requestImageAnalysis(ctx, region, imageURL)
+					resultC <- analysisResult{Picture: entry, Analysis: analysis, Requested: true, Err: err}
+				}(entry)
+			}
+
+			select {
+			case pending <- resultC:
+				return true
+			case <-stop:
+				return false
+			}
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	results := make(chan analysisResult)
+	go func() {
+		defer close(results)
+		for resultC := range pending {
+			results <- <-resultC
+		}
+	}()
+	return results
+}
+
+// forceReanalysis reports whether REANALYZE asks for the picture to be
+// analyzed again even if it is cached, replacing the cached analysis.
+func forceReanalysis(id string) bool {
+	return reanalyzeAll || reanalyzeIDs[id]
+}
+
+// sameImageURL reports whether two preview URLs of picture are of the same
+// image. Flickr previews are identified by their path alone, so that moving
+// to or from a FLICKR_IMAGE_HOST proxy doesn't count as a change.
+func sameImageURL(picture selector.ManifestEntry, a, b string) bool {
+	if !picture.IsFlickr() {
+		return a == b
+	}
+	ua, errA := url.Parse(a)
+	ub, errB := url.Parse(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return ua.Path == ub.Path
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// loadAzureProvider configures an AzureProvider from the environment, with
+// the names of its settings prefixed by prefix.
+func loadAzureProvider(prefix string) *selector.AzureProvider {
+	endpoint := getenv(prefix + "AZURE_ENDPOINT")
+	if endpoint == "" {
+		log.Fatal(prefix + "AZURE_ENDPOINT not set")
+	}
+
+	u := parseAzureEndpoint(prefix+"AZURE_ENDPOINT", endpoint)
+
+	token := loadAzureTokenSource(prefix)
+	keys := loadAzureKeys(prefix)
+	if len(keys) == 0 && token == nil {
+		log.Fatal(prefix + "AZURE_KEY not set")
+	}
+
+	maxRetries := envInt(prefix+"AZURE_MAX_RETRIES", 5)
+	if maxRetries < 0 {
+		log.Fatalf("invalid %sAZURE_MAX_RETRIES %d", prefix, maxRetries)
+	}
+
+	apiVersion := getenv(prefix + "AZURE_API_VERSION")
+	switch apiVersion {
+	case "":
+		apiVersion = "3.1"
+	case "3.1", "4.0":
+	default:
+		log.Fatalf("invalid %sAZURE_API_VERSION %q, expected 3.1 or 4.0", prefix, apiVersion)
+	}
+
+	visualFeatures := envList(prefix+"AZURE_VISUAL_FEATURES", selector.DefaultAzureVisualFeatures)
+	for _, feature := range visualFeatures {
+		if !slices.Contains(selector.AzureVisualFeatures, feature) {
+			log.Fatalf("invalid %sAZURE_VISUAL_FEATURES %q, expected some of %s", prefix, feature, strings.Join(selector.AzureVisualFeatures, ", "))
+		}
+	}
+
+	// The limits apply to the endpoint's host whatever sends to it, so that
+	// text detection shares them too. A secondary provider on the same host
+	// shares the primary's.
+	limitAzureHost(u, prefix)
+
+	return &selector.AzureProvider{Endpoint: endpoint, Keys: keys, Token: token, APIVersion: apiVersion, VisualFeatures: visualFeatures, MaxRetries: maxRetries, Logf: detailf, KeepRaw: envBool(prefix+"AZURE_KEEP_RAW_RESPONSE", false)}
+}
+
+// parseAzureEndpoint parses the endpoint set by the named setting, failing if
+// it is not an http(s) URL.
+func parseAzureEndpoint(name, endpoint string) *url.URL {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatalf("invalid %s %q, expected an http(s) URL", name, endpoint)
+	}
+	return u
+}
+
+// limitAzureHost limits the requests to the host of endpoint by the
+// AZURE_RATE_LIMIT and AZURE_CONCURRENCY prefixed with prefix, unless it
+// already has limits.
+func limitAzureHost(endpoint *url.URL, prefix string) {
+	if _, ok := hostLimits[endpoint.Hostname()]; ok {
+		return
+	}
+	rateLimit := envFloat(prefix+"AZURE_RATE_LIMIT", 0)
+	if rateLimit < 0 {
+		log.Fatalf("invalid %sAZURE_RATE_LIMIT %g", prefix, rateLimit)
+	}
+	concurrency := envInt(prefix+"AZURE_CONCURRENCY", 0)
+	if concurrency < 0 {
+		log.Fatalf("invalid %sAZURE_CONCURRENCY %d", prefix, concurrency)
+	}
+	hostLimits[endpoint.Hostname()] = newHostLimit(concurrency, rateLimit)
+}
+
+// regionAzureEndpoint is the Azure resource a region is analyzed with instead
+// of AZURE_ENDPOINT and AZURE_KEY, either of which it may leave out.
+type regionAzureEndpoint struct {
+	Endpoint string `json:"endpoint"`
+	// Key is one or more comma-separated subscription keys, used instead
+	// of Azure AD authentication if AZURE_AUTH_MODE=token.
+	Key string `json:"key"`
+}
+
+// loadRegionProviders reads REGION_AZURE_ENDPOINTS, a JSON file mapping
+// region names to the Azure resource to analyze them with, returning a
+// provider for each region in it. Apart from the endpoint and key each is set
+// up like base, and each host gets the limits of AZURE_RATE_LIMIT and
+// AZURE_CONCURRENCY of its own.
+func loadRegionProviders(base selector.VisionProvider) map[string]selector.VisionProvider {
+	endpointsFile := getenv("REGION_AZURE_ENDPOINTS")
+	if endpointsFile == "" {
+		return nil
+	}
+	azure, ok := base.(*selector.AzureProvider)
+	if !ok {
+		log.Fatal("REGION_AZURE_ENDPOINTS requires VISION_PROVIDER=azure")
+	}
+	data, err := os.ReadFile(endpointsFile)
+	if err != nil {
+		log.Fatal("invalid REGION_AZURE_ENDPOINTS ", err)
+	}
+	var endpoints map[string]regionAzureEndpoint
+	if err := json.Unmarshal(data, &endpoints); err != nil {
+		log.Fatal("invalid REGION_AZURE_ENDPOINTS ", err)
+	}
+
+	providers := make(map[string]selector.VisionProvider, len(endpoints))
+	for region, e := range endpoints {
+		p := &selector.AzureProvider{
+			Endpoint:       azure.Endpoint,
+			Keys:           azure.Keys,
+			Token:          azure.Token,
+			APIVersion:     azure.APIVersion,
+			VisualFeatures: azure.VisualFeatures,
+			MaxRetries:     azure.MaxRetries,
+			Client:         azure.Client,
+			Logf:           azure.Logf,
+			KeepRaw:        azure.KeepRaw,
+		}
+		if e.Endpoint != "" {
+			p.Endpoint = e.Endpoint
+			limitAzureHost(parseAzureEndpoint("REGION_AZURE_ENDPOINTS endpoint for "+region, e.Endpoint), "")
+		}
+		if e.Key != "" {
+			p.Keys, p.Token = splitList(e.Key), nil
+			if len(p.Keys) == 0 {
+				log.Fatalf("invalid REGION_AZURE_ENDPOINTS key for %s, expected comma-separated keys", region)
+			}
+		}
+		providers[region] = p
+	}
+	return providers
+}
+
+// loadAzureTokenSource configures Azure AD authentication if AZURE_AUTH_MODE
+// selects it, returning nil for subscription key authentication.
+func loadAzureTokenSource(prefix string) selector.AzureTokenSource {
+	switch mode := getenv(prefix + "AZURE_AUTH_MODE"); mode {
+	case "", "key":
+		return nil
+	case "token":
+		if token := getenv(prefix + "AZURE_ACCESS_TOKEN"); token != "" {
+			return selector.StaticAzureToken(token)
+		}
+		return &selector.ManagedIdentityToken{ClientID: getenv(prefix + "AZURE_CLIENT_ID")}
+	default:
+		log.Fatalf("invalid %sAZURE_AUTH_MODE %q, expected key or token", prefix, mode)
+		return nil
+	}
+}
+
+// loadAzureKeys reads the comma-separated keys in AZURE_KEY followed by any
+// numbered AZURE_KEY_1, AZURE_KEY_2, ...
+func loadAzureKeys(prefix string) []string {
+	keys := envList(prefix+"AZURE_KEY", nil)
+	for n := 1; ; n++ {
+		key := getenv(prefix + "AZURE_KEY_" + strconv.Itoa(n))
+		if key == "" {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// cacheBackend selects how analyses are cached between runs: "ndjson" keeps a
+// file per region in ANALYSES_DIR and "sqlite" a single database there.
+var cacheBackend string
+
+// AnalysisCache stores the analyses of a region's pictures between runs.
+// Implementations are safe for concurrent use.
+type AnalysisCache interface {
+	// Get returns the latest entry stored for the picture with the given ID.
+	Get(id string) (AnalysisEntry, bool)
+	// Put stores entry, superseding any earlier entry for the same picture.
+	Put(entry AnalysisEntry) error
+	// Each calls fn with every entry until it returns false.
+	Each(fn func(AnalysisEntry) bool) error
+	Close() error
+}
+
+// sharedCache is set by SHARED_CACHE to also keep every analysis in a cache
+// shared by all regions, so that a picture in several manifests is only
+// analyzed once.
+var sharedCache bool
+
+// sharedCacheName is stored in place of a region name for the shared cache.
+const sharedCacheName = "_shared"
+
+var sharedAnalyses AnalysisCache
+var sharedAnalysesErr error
+var sharedAnalysesOnce sync.Once
+
+// openAnalysisCache opens the cache of region's analyses using the configured
+// backend, reading through to the shared cache if SHARED_CACHE is set.
+func openAnalysisCache(region string) (AnalysisCache, error) {
+	cache, err := openBackendCache(region)
+	if err != nil || !sharedCache {
+		return cache, err
+	}
+	// The shared cache stays open for the rest of the run. Both backends
+	// are safe for concurrent use, so one instance serves every region.
+	sharedAnalysesOnce.Do(func() {
+		sharedAnalyses, sharedAnalysesErr = openBackendCache(sharedCacheName)
+	})
+	if sharedAnalysesErr != nil {
+		cache.Close()
+		return nil, fmt.Errorf("open shared cache: %w", sharedAnalysesErr)
+	}
+	return &readThroughCache{AnalysisCache: cache, shared: sharedAnalyses}, nil
+}
+
+func openBackendCache(name string) (AnalysisCache, error) {
+	if cacheBackend == "sqlite" {
+		return openSQLiteCache(name)
+	}
+	return openNDJSONCache(filepath.Join(analysesDir, name+".ndjson"))
+}
+
+// listCachedRegions returns the regions that have cached analyses.
+func listCachedRegions() ([]string, error) {
+	names, err := listCaches()
+	return slices.DeleteFunc(names, func(name string) bool { return name == sharedCacheName }), err
+}
+
+// listCaches returns the names of every cache, including the shared cache if
+// it exists.
+func listCaches() ([]string, error) {
+	if cacheBackend == "sqlite" {
+		return listSQLiteRegions()
+	}
+	return listNDJSONRegions()
+}
+
+// readThroughCache is a region's cache backed by the shared cache. Entries
+// found only in the shared cache are copied into the region's, so that the
+// region's cache alone still lists every picture it has seen, and entries
+// only in the region's are copied to the shared cache as they are used.
+type readThroughCache struct {
+	AnalysisCache
+	shared AnalysisCache
+}
+
+func (c *readThroughCache) Get(id string) (AnalysisEntry, bool) {
+	if entry, ok := c.AnalysisCache.Get(id); ok {
+		if _, shared := c.shared.Get(id); !shared {
+			if err := c.shared.Put(entry); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return entry, true
+	}
+	entry, ok := c.shared.Get(id)
+	if ok {
+		if err := c.AnalysisCache.Put(entry); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return entry, ok
+}
+
+func (c *readThroughCache) Put(entry AnalysisEntry) error {
+	if err := c.AnalysisCache.Put(entry); err != nil {
+		return err
+	}
+	return c.shared.Put(entry)
+}
+
+// ndjsonCache holds a region's analyses in memory, appending new entries to a
+// file with one JSON entry per line.
+type ndjsonCache struct {
+	mu      sync.RWMutex
+	entries map[string]AnalysisEntry
+	f       *os.File
+	enc     *json.Encoder
+}
+
+func openNDJSONCache(fname string) (*ndjsonCache, error) {
+	entries := readPreexistingAnalyses(fname)
+	f, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonCache{entries: entries, f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (c *ndjsonCache) Get(id string) (AnalysisEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[id]
+	return entry, ok
+}
+
+func (c *ndjsonCache) Put(entry AnalysisEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.enc.Encode(entry); err != nil {
+		return err
+	}
+	c.entries[entry.Picture.ID] = entry
+	return nil
+}
+
+func (c *ndjsonCache) Each(fn func(AnalysisEntry) bool) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, entry := range c.entries {
+		if !fn(entry) {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *ndjsonCache) Close() error {
+	return c.f.Close()
+}
+
+func listNDJSONRegions() ([]string, error) {
+	fnames, err := filepath.Glob(filepath.Join(analysesDir, "*.ndjson"))
+	if err != nil {
+		return nil, err
+	}
+	regions := make([]string, len(fnames))
+	for i, fname := range fnames {
+		regions[i] = strings.TrimSuffix(filepath.Base(fname), ".ndjson")
+	}
+	return regions, nil
+}
+
+// mustOpenAnalysisCache is openAnalysisCache for callers that can't continue
+// without the cache.
+func mustOpenAnalysisCache(region string) AnalysisCache {
+	cache, err := openAnalysisCache(region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cache
+}
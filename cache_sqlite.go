@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteDB is shared by the caches of every region, so that they can be
+// written concurrently without the database being locked.
+var sqliteDB *sql.DB
+var sqliteOnce sync.Once
+
+func openSQLiteDB() *sql.DB {
+	sqliteOnce.Do(func() {
+		db, err := sql.Open("sqlite", filepath.Join(analysesDir, "analyses.sqlite"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		db.SetMaxOpenConns(1)
+		_, err = db.Exec(`
+			PRAGMA journal_mode = WAL;
+			CREATE TABLE IF NOT EXISTS analyses (
+				region TEXT NOT NULL,
+				id TEXT NOT NULL,
+				entry TEXT NOT NULL,
+				PRIMARY KEY (region, id)
+			);`)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sqliteDB = db
+	})
+	return sqliteDB
+}
+
+// sqliteCache looks up a region's analyses in the database as they are
+// needed rather than loading them all up front. Entries are stored as JSON in
+// the same form as the ndjson backend.
+type sqliteCache struct {
+	db     *sql.DB
+	region string
+}
+
+func openSQLiteCache(region string) (*sqliteCache, error) {
+	return &sqliteCache{db: openSQLiteDB(), region: region}, nil
+}
+
+func (c *sqliteCache) Get(id string) (AnalysisEntry, bool) {
+	var data []byte
+	err := c.db.QueryRow(`SELECT entry FROM analyses WHERE region = ? AND id = ?`, c.region, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return AnalysisEntry{}, false
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	var entry AnalysisEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		warnf("Ignoring malformed cached analysis of %s: %v", id, err)
+		return AnalysisEntry{}, false
+	}
+	return entry, !entry.stale()
+}
+
+func (c *sqliteCache) Put(entry AnalysisEntry) error {
+	return putSQLiteEntries(c.db, c.region, []AnalysisEntry{entry})
+}
+
+func (c *sqliteCache) Each(fn func(AnalysisEntry) bool) error {
+	rows, err := c.db.Query(`SELECT entry FROM analyses WHERE region = ?`, c.region)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var entries []AnalysisEntry
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		var entry AnalysisEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			warnf("Ignoring malformed cached analysis: %v", err)
+			continue
+		}
+		if entry.stale() {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// The single connection is released before calling fn, which may use the
+	// cache itself.
+	rows.Close()
+	for _, entry := range entries {
+		if !fn(entry) {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *sqliteCache) Close() error {
+	return nil
+}
+
+// putSQLiteEntries stores entries for region in a single transaction.
+func putSQLiteEntries(db *sql.DB, region string, entries []AnalysisEntry) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO analyses (region, id, entry) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(region, entry.Picture.ID, data); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func listSQLiteRegions() ([]string, error) {
+	rows, err := openSQLiteDB().Query(`SELECT DISTINCT region FROM analyses ORDER BY region`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var regions []string
+	for rows.Next() {
+		var region string
+		if err := rows.Scan(&region); err != nil {
+			return nil, err
+		}
+		regions = append(regions, region)
+	}
+	return regions, rows.Err()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"slices"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// Checkpoint records how far processRegion got through a manifest so that an
+// interrupted run can pick up where it left off.
+type Checkpoint struct {
+	// ManifestHash identifies the manifest the checkpoint applies to. If the
+	// manifest changes the checkpoint is discarded.
+	ManifestHash string `json:"manifestHash"`
+	// Order is the manifestOrder the entries were processed in.
+	Order string `json:"order,omitempty"`
+	// NextIndex is the index of the first manifest entry not yet processed.
+	NextIndex int `json:"nextIndex"`
+	// OKCount is the number of entries written to the output so far.
+	OKCount int `json:"okCount"`
+	// OutSize is the size of the output file after the last processed entry.
+	// Anything past it was written after the checkpoint and is discarded.
+	OutSize int64 `json:"outSize"`
+	// RejectedSize is the size of the rejected output file after the last
+	// processed entry.
+	RejectedSize int64 `json:"rejectedSize"`
+	// SelectedHashes are the perceptual hashes of the pictures selected so
+	// far, by ID, when deduplicating.
+	SelectedHashes map[string]string `json:"selectedHashes,omitempty"`
+	// OwnerCounts is the number of pictures selected so far from each owner.
+	OwnerCounts map[string]int `json:"ownerCounts,omitempty"`
+}
+
+// readCheckpoint returns the checkpoint stored in fname, or nil if there is
+// none.
+func readCheckpoint(fname string) *Checkpoint {
+	data, err := os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		warnf("Ignoring invalid checkpoint %s: %v", fname, err)
+		return nil
+	}
+	return &checkpoint
+}
+
+// writeCheckpoint atomically replaces the checkpoint stored in fname.
+func writeCheckpoint(fname string, checkpoint Checkpoint) {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tmp := fname + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func removeCheckpoint(fname string) {
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+}
+
+// snapshotManifest returns the file to read the manifest at path from and
+// the SHA-256 of its contents. A manifest at a URL is downloaded once into a
+// temporary file in dir, hashed as it is written, so that the hash is of the
+// entries processed even if the remote copy changes meanwhile. The caller
+// removes the temporary file.
+func snapshotManifest(path, dir string) (string, string) {
+	f, err := selector.OpenManifest(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if !slices.Contains(manifestURLs, path) {
+		if _, err := io.Copy(h, f); err != nil {
+			log.Fatal(err)
+		}
+		return path, hex.EncodeToString(h.Sum(nil))
+	}
+
+	snapshot, err := os.CreateTemp(dir, ".manifest-*")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = io.Copy(io.MultiWriter(h, snapshot), f)
+	if closeErr := snapshot.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(snapshot.Name())
+		log.Fatal(err)
+	}
+	return snapshot.Name(), hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// analyzeReport is printed by the analyze command and returned by the serve
+// command.
+type analyzeReport struct {
+	Picture  selector.ManifestEntry `json:"picture"`
+	Analysis selector.ImageAnalysis `json:"analysis"`
+	Cached   bool                   `json:"cached"`
+	OK       bool                   `json:"ok"`
+	Issues   string                 `json:"issues"`
+	Score    float64                `json:"score"`
+	// ObjectFraction counts only objects above OBJECT_CONFIDENCE_MIN, and
+	// RawObjectFraction counts every detected object.
+	ObjectFraction    float64 `json:"objectFraction"`
+	RawObjectFraction float64 `json:"rawObjectFraction"`
+}
+
+// newAnalyzeReport categorizes a picture's analysis with the current config.
+func newAnalyzeReport(picture selector.ManifestEntry, analysis selector.ImageAnalysis, cached bool) analyzeReport {
+	report := analyzeReport{Picture: picture, Analysis: analysis, Cached: cached}
+	report.OK, report.Issues = selector.CategorizePicture(picture, analysis, categorizeConfig)
+	report.Score = selector.ScoreImage(analysis, categorizeConfig)
+	report.ObjectFraction = selector.ObjectAreaFraction(analysis, categorizeConfig.ObjectConfidenceMin)
+	report.RawObjectFraction = selector.ObjectAreaFraction(analysis, 0)
+	return report
+}
+
+var staticFlickrPathRe = regexp.MustCompile(`^/([^/]+)/(\d+)_([0-9a-f]+)(?:_[a-z0-9]+)?\.jpg$`)
+
+// runAnalyze implements "analyze <flickr-url-or-id>", which analyzes and
+// categorizes a single picture and prints the result.
+func runAnalyze(args []string) {
+	if len(args) != 1 {
+		log.Fatal("usage: analyze <flickr-url-or-id>")
+	}
+	picture, err := parsePictureRef(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var report analyzeReport
+	if entry, ok := findCachedAnalysis(picture.ID); ok {
+		report = newAnalyzeReport(entry.Picture, entry.Analysis, true)
+	} else {
+		region := ""
+		if picture.Secret == "" {
+			var found bool
+			region, picture, found = findManifestEntry(picture.ID)
+			if !found {
+				log.Fatalf("photo %s is not in the analyses cache or any manifest; pass its live.staticflickr.com URL instead", picture.ID)
+			}
+		}
+		analysis, err := requestImageAnalysis(context.Background(), region, flickrImagePreviewURL(picture))
+		if err != nil {
+			log.Fatal(err)
+		}
+		report = newAnalyzeReport(picture, analysis, false)
+		if region != "" {
+			appendAnalysis(region, newAnalysisEntry(picture, analysis))
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(report); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parsePictureRef accepts a photo ID, a flickr.com photo page URL or a
+// live.staticflickr.com image URL, returning as much of the manifest entry as
+// it identifies.
+func parsePictureRef(ref string) (selector.ManifestEntry, error) {
+	if !strings.Contains(ref, "/") {
+		return selector.ManifestEntry{ID: ref}, nil
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		return selector.ManifestEntry{}, err
+	}
+	if strings.HasSuffix(u.Host, "staticflickr.com") || u.Host == flickrImageHost {
+		m := staticFlickrPathRe.FindStringSubmatch(u.Path)
+		if m == nil {
+			return selector.ManifestEntry{}, fmt.Errorf("unrecognized image URL %s", ref)
+		}
+		return selector.ManifestEntry{Server: m[1], ID: m[2], Secret: m[3]}, nil
+	}
+
+	// https://www.flickr.com/photos/{owner-id}/{photo-id}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) >= 3 && parts[0] == "photos" {
+		return selector.ManifestEntry{Owner: parts[1], ID: parts[2]}, nil
+	}
+	return selector.ManifestEntry{}, fmt.Errorf("unrecognized photo URL %s", ref)
+}
+
+// findCachedAnalysis looks for id in every region's analyses cache.
+func findCachedAnalysis(id string) (AnalysisEntry, bool) {
+	regions, err := listCachedRegions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, region := range regions {
+		cache := mustOpenAnalysisCache(region)
+		entry, ok := cache.Get(id)
+		cache.Close()
+		if ok && entry.Failure == nil {
+			return entry, true
+		}
+	}
+	return AnalysisEntry{}, false
+}
+
+// findManifestEntry looks for id in every manifest, returning the region it
+// belongs to.
+func findManifestEntry(id string) (string, selector.ManifestEntry, bool) {
+	for _, manifestPath := range listManifests() {
+		var found selector.ManifestEntry
+		err := selector.StreamManifestFile(manifestPath, func(entry selector.ManifestEntry) bool {
+			if entry.ID == id {
+				found = entry
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if found.ID != "" {
+			return selector.ManifestRegion(manifestPath), found, true
+		}
+	}
+	return "", selector.ManifestEntry{ID: id}, false
+}
+
+func appendAnalysis(region string, entry AnalysisEntry) {
+	cache := mustOpenAnalysisCache(region)
+	defer cache.Close()
+	if err := cache.Put(entry); err != nil {
+		log.Fatal(err)
+	}
+}
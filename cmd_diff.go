@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// runDiff implements "diff <old-config> <new-config> [region...]", which
+// categorizes the cached analyses of the given regions, or every cached
+// region, with the thresholds of each config file and lists the pictures
+// whose classification differs. Settings a file leaves out keep their
+// current values.
+func runDiff(args []string) {
+	if len(args) < 2 {
+		log.Fatal("usage: diff <old-config> <new-config> [region...]")
+	}
+	oldFile, newFile := args[0], args[1]
+	oldConfig := loadCategorizeConfigFile(oldFile)
+	newConfig := loadCategorizeConfigFile(newFile)
+
+	cached, err := listCachedRegions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	regions := args[2:]
+	if len(regions) == 0 {
+		if len(cached) == 0 {
+			log.Fatal("no analyses found")
+		}
+		regions = cached
+	}
+	for _, region := range regions {
+		if !slices.Contains(cached, region) {
+			log.Fatalf("no analyses of region %s", region)
+		}
+	}
+
+	for i, region := range regions {
+		if i > 0 {
+			fmt.Println()
+		}
+		analyses := readCachedAnalyses(region)
+		d := diffCategorizations(analyses, oldConfig, newConfig)
+		printDiff(os.Stdout, region, oldFile, newFile, analyses, d)
+	}
+}
+
+// loadCategorizeConfigFile loads the categorization settings with those of
+// the config file fname in place of the current ones.
+func loadCategorizeConfigFile(fname string) selector.CategorizeConfig {
+	settings, err := readConfigFile(fname)
+	if err != nil {
+		log.Fatal(err)
+	}
+	previous := make(map[string]*string, len(settings))
+	for name, value := range settings {
+		if v, ok := os.LookupEnv(name); ok {
+			previous[name] = &v
+		} else {
+			previous[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	defer func() {
+		for name, v := range previous {
+			if v != nil {
+				os.Setenv(name, *v)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}()
+	return loadCategorizeConfig()
+}
+
+// categorizationDiff is how categorizing the same analyses with two configs
+// differs.
+type categorizationDiff struct {
+	// OldPassed and NewPassed count the pictures passing with each config.
+	OldPassed, NewPassed int
+	// Rejected are the IDs of pictures that only pass with the old config,
+	// and Accepted those that only pass with the new one, in order of ID.
+	Rejected, Accepted []string
+	// Issues are the issues of each picture in Rejected with the new config,
+	// and each in Accepted with the old one.
+	Issues map[string]string
+}
+
+func diffCategorizations(analyses map[string]AnalysisEntry, oldConfig, newConfig selector.CategorizeConfig) categorizationDiff {
+	d := categorizationDiff{Issues: make(map[string]string)}
+	var rejected, accepted []selector.ManifestEntry
+	for id, entry := range analyses {
+		if entry.Failure != nil {
+			continue
+		}
+		oldOK, oldIssues := selector.CategorizePicture(entry.Picture, entry.Analysis, oldConfig)
+		newOK, newIssues := selector.CategorizePicture(entry.Picture, entry.Analysis, newConfig)
+		if oldOK {
+			d.OldPassed++
+		}
+		if newOK {
+			d.NewPassed++
+		}
+		if oldOK && !newOK {
+			rejected = append(rejected, entry.Picture)
+			d.Issues[id] = newIssues
+		} else if !oldOK && newOK {
+			accepted = append(accepted, entry.Picture)
+			d.Issues[id] = oldIssues
+		}
+	}
+	slices.SortFunc(rejected, compareManifestIDs)
+	slices.SortFunc(accepted, compareManifestIDs)
+	for _, picture := range rejected {
+		d.Rejected = append(d.Rejected, picture.ID)
+	}
+	for _, picture := range accepted {
+		d.Accepted = append(d.Accepted, picture.ID)
+	}
+	return d
+}
+
+func printDiff(w io.Writer, region, oldFile, newFile string, analyses map[string]AnalysisEntry, d categorizationDiff) {
+	fmt.Fprintf(w, "%s: %d analyses, %d pass with %s, %d with %s\n", region, len(analyses), d.OldPassed, oldFile, d.NewPassed, newFile)
+	fmt.Fprintf(w, "\nPass -> fail (%d):\n", len(d.Rejected))
+	for _, id := range d.Rejected {
+		fmt.Fprintf(w, "  %s  %s\n", id, d.Issues[id])
+	}
+	fmt.Fprintf(w, "\nFail -> pass (%d):\n", len(d.Accepted))
+	for _, id := range d.Accepted {
+		fmt.Fprintf(w, "  %s  %s\n", id, d.Issues[id])
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	flickrRequestTokenURL = "https://www.flickr.com/services/oauth/request_token"
+	flickrAuthorizeURL    = "https://www.flickr.com/services/oauth/authorize"
+	flickrAccessTokenURL  = "https://www.flickr.com/services/oauth/access_token"
+)
+
+// runFlickrAuth implements "flickr-auth", which has the user authorize read
+// access to their Flickr account and saves the token FLICKR_OAUTH uses in
+// FLICKR_TOKEN_FILE. Flickr's tokens don't expire, so this is only needed
+// again if the token is revoked.
+func runFlickrAuth(args []string) {
+	if len(args) > 0 {
+		log.Fatal("usage: flickr-auth")
+	}
+	consumerKey, consumerSecret := loadFlickrConsumer("flickr-auth")
+	creds := &flickrCredentials{ConsumerKey: consumerKey, ConsumerSecret: consumerSecret}
+
+	// Out of band, Flickr shows the user a code to enter here rather than
+	// redirecting to a callback.
+	values, err := flickrOAuthCall(creds, flickrRequestTokenURL, url.Values{"oauth_callback": {"oob"}})
+	if err != nil {
+		log.Fatal("request token: ", err)
+	}
+	creds.Token = values.Get("oauth_token")
+	creds.TokenSecret = values.Get("oauth_token_secret")
+
+	authorize := url.Values{"oauth_token": {creds.Token}, "perms": {"read"}}
+	fmt.Println("Open this URL, authorize access and enter the code shown:")
+	fmt.Println()
+	fmt.Println("  " + flickrAuthorizeURL + "?" + authorize.Encode())
+	fmt.Println()
+	fmt.Print("Code: ")
+	verifier, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		log.Fatal("read code: ", err)
+	}
+
+	values, err = flickrOAuthCall(creds, flickrAccessTokenURL, url.Values{"oauth_verifier": {strings.TrimSpace(verifier)}})
+	if err != nil {
+		log.Fatal("access token: ", err)
+	}
+	creds.Token = values.Get("oauth_token")
+	creds.TokenSecret = values.Get("oauth_token_secret")
+	creds.Username = values.Get("username")
+	if creds.Token == "" || creds.TokenSecret == "" {
+		log.Fatal("access token: missing from response")
+	}
+
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tokenFile := flickrTokenFile()
+	if err := os.WriteFile(tokenFile, append(data, '\n'), 0600); err != nil {
+		log.Fatal(err)
+	}
+	infof("Saved token of %s to %s, set FLICKR_OAUTH=true to use it", creds.Username, tokenFile)
+}
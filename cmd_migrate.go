@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+)
+
+// runMigrate implements "migrate [region...]", which imports the ndjson
+// analyses of the given regions, or every region, into the SQLite cache.
+// Entries already in the database are replaced.
+func runMigrate(args []string) {
+	regions := args
+	if len(regions) == 0 {
+		var err error
+		regions, err = listNDJSONRegions()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(regions) == 0 {
+			log.Fatal("no ndjson analyses found")
+		}
+	}
+
+	db := openSQLiteDB()
+	for _, region := range regions {
+		analyses := readPreexistingAnalyses(filepath.Join(analysesDir, region+".ndjson"))
+		entries := make([]AnalysisEntry, 0, len(analyses))
+		for _, entry := range analyses {
+			entries = append(entries, entry)
+		}
+		if err := putSQLiteEntries(db, region, entries); err != nil {
+			log.Fatal(err)
+		}
+		infof("Imported %d analyses of %s", len(entries), region)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// runPrune implements "prune [region...]", which removes the cached analyses
+// of pictures that are no longer in any manifest from the given regions, or
+// every region. With DRY_RUN it only reports what would be removed.
+func runPrune(args []string) {
+	ids := make(map[string]bool)
+	for _, manifestPath := range listManifests() {
+		err := selector.StreamManifestFile(manifestPath, func(entry selector.ManifestEntry) bool {
+			ids[entry.ID] = true
+			return true
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(ids) == 0 {
+		log.Fatal("no manifest entries found, refusing to prune every analysis")
+	}
+
+	regions := args
+	if len(regions) == 0 {
+		var err error
+		regions, err = listCaches()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	totalRemoved, totalBytes := 0, int64(0)
+	for _, region := range regions {
+		var removed int
+		var reclaimed int64
+		var err error
+		if cacheBackend == "sqlite" {
+			removed, reclaimed, err = pruneSQLiteRegion(region, ids)
+		} else {
+			removed, reclaimed, err = pruneNDJSONFile(filepath.Join(analysesDir, region+".ndjson"), ids)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		infof("%s %d analyses (%d bytes) from %s", verb, removed, reclaimed, region)
+		totalRemoved += removed
+		totalBytes += reclaimed
+	}
+	infof("%s %d analyses (%d bytes) in total", verb, totalRemoved, totalBytes)
+}
+
+// pruneNDJSONFile rewrites the analyses file fname without the lines for
+// pictures not in ids, returning how many pictures were removed and the bytes
+// reclaimed. Lines that can't be decoded are kept for readPreexistingAnalyses
+// to deal with.
+func pruneNDJSONFile(fname string, ids map[string]bool) (int, int64, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var kept bytes.Buffer
+	removed := make(map[string]bool)
+	var reclaimed int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+		var entry struct {
+			Picture struct {
+				ID string `json:"id"`
+			} `json:"picture"`
+		}
+		if json.Unmarshal(line, &entry) == nil && !ids[entry.Picture.ID] {
+			removed[entry.Picture.ID] = true
+			reclaimed += int64(len(line))
+		} else {
+			kept.Write(line)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if dryRun || len(removed) == 0 {
+		return len(removed), reclaimed, nil
+	}
+	if err := os.WriteFile(fname+".tmp", kept.Bytes(), 0640); err != nil {
+		return 0, 0, err
+	}
+	if err := os.Rename(fname+".tmp", fname); err != nil {
+		return 0, 0, err
+	}
+	return len(removed), reclaimed, nil
+}
+
+// pruneSQLiteRegion deletes region's analyses of pictures not in ids from the
+// database, returning how many were removed and the size of their entries.
+func pruneSQLiteRegion(region string, ids map[string]bool) (int, int64, error) {
+	db := openSQLiteDB()
+	rows, err := db.Query(`SELECT id, length(entry) FROM analyses WHERE region = ?`, region)
+	if err != nil {
+		return 0, 0, err
+	}
+	var remove []string
+	var reclaimed int64
+	for rows.Next() {
+		var id string
+		var size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		if !ids[id] {
+			remove = append(remove, id)
+			reclaimed += size
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	if dryRun || len(remove) == 0 {
+		return len(remove), reclaimed, nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`DELETE FROM analyses WHERE region = ? AND id = ?`)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmt.Close()
+	for _, id := range remove {
+		if _, err := stmt.Exec(region, id); err != nil {
+			return 0, 0, err
+		}
+	}
+	return len(remove), reclaimed, tx.Commit()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// runRecategorize implements "recategorize [region...]", which rewrites the
+// output of the given regions, or every cached region, by categorizing their
+// cached analyses again. It reads no manifests and makes no requests, so
+// pictures are considered in order of ID (or as SHUFFLE orders them) rather
+// than manifest order.
+func runRecategorize(args []string) {
+	cached, err := listCachedRegions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	regions := args
+	if len(regions) == 0 {
+		if len(cached) == 0 {
+			log.Fatal("no analyses found")
+		}
+		regions = cached
+	}
+	for _, region := range regions {
+		if !slices.Contains(cached, region) {
+			log.Fatalf("no analyses of region %s", region)
+		}
+	}
+	if err := os.MkdirAll(outDir, 0750); err != nil {
+		log.Fatal(err)
+	}
+	for _, region := range regions {
+		recategorizeRegion(region, regionTarget(region))
+	}
+}
+
+func recategorizeRegion(region string, target int) {
+	var entries []selector.ManifestEntry
+	analyses := make(map[string]AnalysisEntry)
+	for id, entry := range readCachedAnalyses(region) {
+		if entry.Failure == nil {
+			entries = append(entries, entry.Picture)
+			analyses[id] = entry
+		}
+	}
+	slices.SortFunc(entries, compareManifestIDs)
+
+	outFilename := filepath.Join(outDir, region+outputExtension())
+	outFile, err := os.Create(tempOutputFilename(outFilename))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+	outWriter, err := newOutputWriter(outFile, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rejectedFilename := filepath.Join(outDir, region+".rejected.ndjson")
+	rejectedFile, err := os.Create(tempOutputFilename(rejectedFilename))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rejectedFile.Close()
+	rejectedEnc := json.NewEncoder(rejectedFile)
+	rejectedEnc.SetEscapeHTML(false)
+
+	okCount := 0
+	var candidates []candidate
+	err = orderedManifestSource(sliceManifestSource(entries))(func(picture selector.ManifestEntry) bool {
+		entry := analyses[picture.ID]
+		if selectionMode != "first" {
+			if issues := strings.Join(selector.ContentIssues(picture, entry.Analysis, categorizeConfig), ","); issues != "" {
+				writeRejected(rejectedEnc, picture, issues)
+			} else {
+				candidates = append(candidates, candidate{Entry: entry, Score: selector.ScoreImage(entry.Analysis, categorizeConfig)})
+			}
+			return !candidatePoolFull(candidates)
+		}
+
+		ok, issues := selector.CategorizePicture(picture, entry.Analysis, categorizeConfig)
+		if !ok {
+			writeRejected(rejectedEnc, picture, issues)
+			return true
+		}
+		okCount++
+		if err := outWriter.Write(picture, entry.Analysis); err != nil {
+			log.Fatal(err)
+		}
+		return okCount < target
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if selectionMode != "first" {
+		selected, rest := selectCandidates(candidates, target, func(candidate) string { return "" })
+		for _, c := range selected {
+			if err := outWriter.Write(c.Entry.Picture, c.Entry.Analysis); err != nil {
+				log.Fatal(err)
+			}
+		}
+		for _, c := range rest {
+			writeRejected(rejectedEnc, c.Entry.Picture, c.Issue)
+		}
+		okCount = len(selected)
+	}
+
+	if err := publishOutput(outFilename, false); err != nil {
+		log.Fatal(err)
+	}
+	if err := publishOutputFile(rejectedFilename, false); err != nil {
+		log.Fatal(err)
+	}
+
+	infof("%s: found %d of %d from %d cached analyses, wrote %s", region, okCount, target, len(entries), outputDescription(outFilename))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runReview implements "review [region...]", which writes the output of the
+// given regions, or every region with candidates awaiting review, from the
+// pictures approved in out/<region>.review.txt. Pictures rejected in review
+// are added to out/<region>.rejected.ndjson.
+func runReview(args []string) {
+	regions := args
+	if len(regions) == 0 {
+		matches, err := filepath.Glob(filepath.Join(outDir, "*.candidates.ndjson"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, match := range matches {
+			regions = append(regions, strings.TrimSuffix(filepath.Base(match), ".candidates.ndjson"))
+		}
+		if len(regions) == 0 {
+			log.Fatal("no candidates awaiting review")
+		}
+	}
+
+	for _, region := range regions {
+		candidates, err := readReviewCandidates(candidatesFilename(region))
+		if err != nil {
+			log.Fatal(err)
+		}
+		decisions, err := readReviewDecisions(reviewDecisionsFilename(region))
+		if err != nil {
+			log.Fatal(err)
+		}
+		var undecided []string
+		for _, c := range candidates {
+			if decisions[c.Picture.ID] == "" {
+				undecided = append(undecided, c.Picture.ID)
+			}
+		}
+		if len(undecided) > 0 {
+			log.Fatalf("%s: no decision for %s", reviewDecisionsFilename(region), strings.Join(undecided, ", "))
+		}
+
+		outFilename := filepath.Join(outDir, region+outputExtension())
+		outFile, err := os.Create(tempOutputFilename(outFilename))
+		if err != nil {
+			log.Fatal(err)
+		}
+		outWriter, err := newOutputWriter(outFile, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rejectedFile, err := os.OpenFile(filepath.Join(outDir, region+".rejected.ndjson"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rejectedEnc := json.NewEncoder(rejectedFile)
+		rejectedEnc.SetEscapeHTML(false)
+
+		approved := 0
+		for _, c := range candidates {
+			if decisions[c.Picture.ID] == "approve" {
+				approved++
+				if err := outWriter.Write(c.Picture, c.Analysis); err != nil {
+					log.Fatal(err)
+				}
+			} else {
+				writeRejected(rejectedEnc, c.Picture, "rejected in review")
+			}
+		}
+		outFile.Close()
+		rejectedFile.Close()
+		if err := publishOutput(outFilename, false); err != nil {
+			log.Fatal(err)
+		}
+		infof("Wrote %s with %d of %d candidates approved", outputDescription(outFilename), approved, len(candidates))
+	}
+}
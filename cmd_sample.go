@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// runSample implements "sample <n> [region...]", which analyzes a random
+// sample of n entries from the manifest of each of the given regions, or
+// every region, and reports how many would pass and why the others would
+// not. Nothing is written to the output, but the analyses are cached as
+// usual so a full run can reuse them.
+func runSample(args []string) {
+	if len(args) < 1 {
+		log.Fatal("usage: sample <n> [region...]")
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		log.Fatalf("invalid sample size %q", args[0])
+	}
+	if err := os.MkdirAll(analysesDir, 0750); err != nil {
+		log.Fatal(err)
+	}
+
+	regions := args[1:]
+	manifests := make(map[string]string)
+	for _, manifestPath := range listManifests() {
+		region := selector.ManifestRegion(manifestPath)
+		manifests[region] = manifestPath
+		if len(args) == 1 {
+			regions = append(regions, region)
+		}
+	}
+
+	tags := ruleTags(categorizeConfig.Require)
+	for i, region := range regions {
+		manifestPath, ok := manifests[region]
+		if !ok {
+			log.Fatalf("no manifest for region %s", region)
+		}
+		var duplicates int
+		sample, err := sampleManifest(uniqueManifestSource(fileManifestSource(manifestPath), &duplicates), n)
+		if err != nil {
+			log.Fatal(err)
+		}
+		analyses, missing := analyzeSample(region, sample)
+		if i > 0 {
+			fmt.Println()
+		}
+		printStats(os.Stdout, fmt.Sprintf("%s (sample of %d)", region, len(sample)), analyses, tags)
+		if missing > 0 {
+			fmt.Printf("%d could not be analyzed\n", missing)
+		}
+	}
+}
+
+// sampleManifest chooses n entries of src uniformly at random, keeping their
+// manifest order.
+func sampleManifest(src manifestSource, n int) ([]selector.ManifestEntry, error) {
+	type indexed struct {
+		index int
+		entry selector.ManifestEntry
+	}
+	// Reservoir sampling, so that the manifest need not fit in memory.
+	var reservoir []indexed
+	i := 0
+	err := src(func(entry selector.ManifestEntry) bool {
+		if len(reservoir) < n {
+			reservoir = append(reservoir, indexed{i, entry})
+		} else if j := rand.IntN(i + 1); j < n {
+			reservoir[j] = indexed{i, entry}
+		}
+		i++
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(reservoir, func(a, b indexed) int { return a.index - b.index })
+	sample := make([]selector.ManifestEntry, len(reservoir))
+	for k, r := range reservoir {
+		sample[k] = r.entry
+	}
+	return sample, nil
+}
+
+// analyzeSample looks up or requests the analysis of each picture in sample,
+// caching new ones. It returns the analyses by picture ID and the number of
+// pictures that were skipped or could not be analyzed.
+func analyzeSample(region string, sample []selector.ManifestEntry) (map[string]AnalysisEntry, int) {
+	cache := mustOpenAnalysisCache(region)
+	defer cache.Close()
+
+	analyses := make(map[string]AnalysisEntry)
+	missing := 0
+	stop := make(chan struct{})
+	defer close(stop)
+	for result := range analyzeEntries(context.Background(), region, sliceManifestSource(sample), cache, concurrency, !dryRun, stop) {
+		if result.Requested {
+			cacheAnalysisResult(cache, result)
+		}
+		switch {
+		case result.Skip != "" || result.Uncached:
+			missing++
+		case result.Err != nil && selector.IsPermanentError(result.Err):
+			analyses[result.Picture.ID] = AnalysisEntry{Picture: result.Picture, Failure: &AnalysisFailure{Reason: result.Err.Error()}}
+		case result.Err != nil:
+			logImage(region, "ERR", 0, result.Picture, result.Err.Error())
+			missing++
+		default:
+			analyses[result.Picture.ID] = AnalysisEntry{Picture: result.Picture, Analysis: result.Analysis}
+		}
+	}
+	return analyses, missing
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// serveRegion is the region whose cache holds the analyses of pictures that
+// the serve command is asked about without a region.
+const serveRegion = "serve"
+
+// runServe implements "serve", which answers requests to analyze and
+// categorize single pictures over HTTP on SERVE_ADDR until interrupted.
+func runServe(args []string) {
+	if len(args) > 0 {
+		log.Fatal("usage: serve")
+	}
+	addr := envString("SERVE_ADDR", "localhost:8080")
+
+	if err := os.MkdirAll(analysesDir, 0750); err != nil {
+		log.Fatal(err)
+	}
+	s := newSubjectServer()
+	defer s.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /analyze", s.handleAnalyze)
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			warnf("Error shutting down server: %v", err)
+		}
+	}()
+
+	infof("Serving on %s/analyze", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// subjectServer keeps the analyses caches of every region open while serving,
+// so that each picture is looked up in all of them as the analyze command
+// does.
+type subjectServer struct {
+	mu      sync.Mutex
+	regions []string
+	caches  map[string]AnalysisCache
+}
+
+func newSubjectServer() *subjectServer {
+	s := &subjectServer{caches: make(map[string]AnalysisCache)}
+	cached, err := listCachedRegions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, manifestPath := range listManifests() {
+		s.regions = append(s.regions, selector.ManifestRegion(manifestPath))
+	}
+	s.regions = append(s.regions, cached...)
+	s.regions = append(s.regions, serveRegion)
+	slices.Sort(s.regions)
+	s.regions = slices.Compact(s.regions)
+	for _, region := range cached {
+		s.caches[region] = mustOpenAnalysisCache(region)
+	}
+	return s
+}
+
+// cache returns region's cache, opening it if it is new.
+func (s *subjectServer) cache(region string) (AnalysisCache, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cache, ok := s.caches[region]; ok {
+		return cache, nil
+	}
+	cache, err := openAnalysisCache(region)
+	if err != nil {
+		return nil, err
+	}
+	s.caches[region] = cache
+	return cache, nil
+}
+
+// lookup looks for the analysis of the picture with the given ID in every
+// open cache.
+func (s *subjectServer) lookup(id string) (AnalysisEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cache := range s.caches {
+		if entry, ok := cache.Get(id); ok && entry.Failure == nil {
+			return entry, true
+		}
+	}
+	return AnalysisEntry{}, false
+}
+
+func (s *subjectServer) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cache := range s.caches {
+		cache.Close()
+	}
+}
+
+// handleAnalyze serves GET /analyze?id=...&owner=...&secret=...&server=...,
+// responding with the analyze command's report on the picture. The secret and
+// server are only needed if the picture hasn't been analyzed before, and new
+// analyses are cached in the given region, or else in serveRegion.
+func (s *subjectServer) handleAnalyze(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	picture := selector.ManifestEntry{
+		ID:     query.Get("id"),
+		Owner:  query.Get("owner"),
+		Secret: query.Get("secret"),
+		Server: query.Get("server"),
+	}
+	region := query.Get("region")
+	if region == "" {
+		region = serveRegion
+	}
+	if picture.ID == "" {
+		writeServeError(w, http.StatusBadRequest, errors.New("id is required"))
+		return
+	}
+	if !slices.Contains(s.regions, region) {
+		writeServeError(w, http.StatusBadRequest, fmt.Errorf("unknown region %s", region))
+		return
+	}
+
+	if entry, ok := s.lookup(picture.ID); ok {
+		writeServeJSON(w, http.StatusOK, newAnalyzeReport(entry.Picture, entry.Analysis, true))
+		return
+	}
+	if picture.Secret == "" || picture.Server == "" {
+		writeServeError(w, http.StatusBadRequest, fmt.Errorf("photo %s has not been analyzed, secret and server are required", picture.ID))
+		return
+	}
+
+	analysis, err := requestImageAnalysis(r.Context(), region, flickrImagePreviewURL(picture))
+	if selector.IsPermanentError(err) {
+		writeServeError(w, http.StatusUnprocessableEntity, err)
+		return
+	} else if err != nil {
+		warnf("Analyzing %s failed: %v", picture.ID, err)
+		writeServeError(w, http.StatusBadGateway, err)
+		return
+	}
+	cache, err := s.cache(region)
+	if err == nil {
+		err = cache.Put(newAnalysisEntry(picture, analysis))
+	}
+	if err != nil {
+		warnf("Failed to cache analysis of %s: %v", picture.ID, err)
+	}
+	writeServeJSON(w, http.StatusOK, newAnalyzeReport(picture, analysis, false))
+}
+
+func writeServeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		detailf("Error writing response: %v", err)
+	}
+}
+
+func writeServeError(w http.ResponseWriter, status int, err error) {
+	writeServeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"contourguessr-subject-selector/selector"
+)
+
+const statsBuckets = 10
+const statsBarWidth = 40
+
+// runStats implements "stats [region-or-file...]", which summarizes cached
+// analyses to help choose thresholds empirically. Arguments ending in .ndjson
+// are read as analyses files regardless of CACHE_BACKEND. With no arguments
+// every cached region is summarized.
+func runStats(args []string) {
+	if len(args) == 0 {
+		regions, err := listCachedRegions()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(regions) == 0 {
+			log.Fatal("no analyses found")
+		}
+		args = regions
+	}
+
+	regions, err := listCachedRegions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tags := ruleTags(categorizeConfig.Require)
+	for i, arg := range args {
+		var analyses map[string]AnalysisEntry
+		if strings.HasSuffix(arg, ".ndjson") {
+			if _, err := os.Stat(arg); err != nil {
+				log.Fatal(err)
+			}
+			analyses = readPreexistingAnalyses(arg)
+		} else if slices.Contains(regions, arg) {
+			analyses = readCachedAnalyses(arg)
+		} else {
+			log.Fatalf("no analyses of region %s", arg)
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		printStats(os.Stdout, arg, analyses, tags)
+	}
+}
+
+// readCachedAnalyses returns every cached analysis of region by picture ID.
+func readCachedAnalyses(region string) map[string]AnalysisEntry {
+	cache := mustOpenAnalysisCache(region)
+	defer cache.Close()
+	analyses := make(map[string]AnalysisEntry)
+	err := cache.Each(func(entry AnalysisEntry) bool {
+		analyses[entry.Picture.ID] = entry
+		return true
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return analyses
+}
+
+// printStats writes how many analyses pass categorization, the issues the
+// others were rejected for and histograms of the confidence of each of tags.
+func printStats(w io.Writer, name string, analyses map[string]AnalysisEntry, tags []string) {
+	failed := 0
+	passed := 0
+	rejections := make(map[string]int)
+	histograms := make(map[string]*[statsBuckets]int)
+	missing := make(map[string]int)
+	for _, tag := range tags {
+		histograms[tag] = new([statsBuckets]int)
+	}
+
+	for _, entry := range analyses {
+		if entry.Failure != nil {
+			failed++
+			continue
+		}
+		ok, issues := selector.CategorizePicture(entry.Picture, entry.Analysis, categorizeConfig)
+		if ok {
+			passed++
+		} else {
+			for _, issue := range strings.Split(issues, ",") {
+				rejections[selector.IssueType(issue)]++
+			}
+		}
+
+		confidences := selector.TagConfidences(entry.Analysis)
+		for _, tag := range tags {
+			c, found := confidences[tag]
+			if !found {
+				missing[tag]++
+				continue
+			}
+			bucket := min(int(c*statsBuckets), statsBuckets-1)
+			histograms[tag][max(bucket, 0)]++
+		}
+	}
+	analyzed := len(analyses) - failed
+
+	fmt.Fprintf(w, "%s: %d analyses, %d failed permanently\n", name, len(analyses), failed)
+	if analyzed == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%d of %d pass (%.1f%%)\n", passed, analyzed, float64(passed)*100/float64(analyzed))
+
+	if len(rejections) > 0 {
+		fmt.Fprintln(w, "\nRejections:")
+		for _, issue := range issuesByCount(rejections) {
+			fmt.Fprintf(w, "  %6d  %s\n", rejections[issue], issue)
+		}
+	}
+
+	for _, tag := range tags {
+		fmt.Fprintf(w, "\n%s (missing from %d):\n", tag, missing[tag])
+		counts := histograms[tag]
+		largest := slices.Max(counts[:])
+		for i, n := range counts {
+			bar := 0
+			if largest > 0 {
+				bar = n * statsBarWidth / largest
+			}
+			lo := float64(i) / statsBuckets
+			line := fmt.Sprintf("  %.1f-%.1f %6d %s", lo, lo+1.0/statsBuckets, n, strings.Repeat("#", bar))
+			fmt.Fprintln(w, strings.TrimRight(line, " "))
+		}
+	}
+}
+
+// ruleTags returns the tags the rules refer to, in order of first use.
+func ruleTags(rules []selector.Rule) []string {
+	var tags []string
+	var visit func(r selector.Rule)
+	visit = func(r selector.Rule) {
+		if r.Tag != "" && !slices.Contains(tags, r.Tag) {
+			tags = append(tags, r.Tag)
+		}
+		for _, sub := range r.All {
+			visit(sub)
+		}
+		for _, sub := range r.Any {
+			visit(sub)
+		}
+	}
+	for _, r := range rules {
+		visit(r)
+	}
+	return tags
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// loadCategorizeConfig reads the categorization thresholds from the
+// environment, falling back to the defaults for any that are unset. If
+// RULES_FILE is set the rules file it names takes precedence.
+func loadCategorizeConfig() selector.CategorizeConfig {
+	cfg := selector.DefaultCategorizeConfig()
+	cfg.Require = selector.ThresholdRules(
+		envFloat("OUTDOOR_THRESHOLD", 0.8),
+		envFloat("MOUNTAIN_THRESHOLD", 0.8),
+		envFloat("SKY_THRESHOLD", 0.8),
+	)
+	if s := getenv("TAG_GROUPS"); s != "" {
+		rules, err := selector.ParseTagGroups(s)
+		if err != nil {
+			log.Fatal("invalid TAG_GROUPS ", err)
+		}
+		cfg.Require = rules
+	}
+	cfg.RejectTags = envFloatMap("REJECT_TAGS", cfg.RejectTags)
+	cfg.MinTags = envInt("MIN_TAGS", cfg.MinTags)
+	if cfg.MinTags < 0 {
+		log.Fatal("invalid MIN_TAGS ", cfg.MinTags)
+	}
+	cfg.AdultScoreMax = envFloat("ADULT_SCORE_MAX", cfg.AdultScoreMax)
+	cfg.RacyScoreMax = envFloat("RACY_SCORE_MAX", cfg.RacyScoreMax)
+	cfg.GoreScoreMax = envFloat("GORE_SCORE_MAX", cfg.GoreScoreMax)
+	cfg.ObjectAreaMax = envFloat("OBJECT_AREA_MAX", cfg.ObjectAreaMax)
+	cfg.ObjectClassAreaMax = envFloatMap("OBJECT_CLASS_AREA_MAX", cfg.ObjectClassAreaMax)
+	cfg.ObjectConfidenceMin = envFloat("OBJECT_CONFIDENCE_MIN", cfg.ObjectConfidenceMin)
+	cfg.IgnoreObjectClasses = envList("IGNORE_OBJECT_CLASSES", cfg.IgnoreObjectClasses)
+	cfg.AllowMissingAdult = envBool("ALLOW_MISSING_ADULT", cfg.AllowMissingAdult)
+	cfg.AllowMissingColor = envBool("ALLOW_MISSING_COLOR", cfg.AllowMissingColor)
+	cfg.RequireDominantColors = envList("REQUIRE_DOMINANT_COLORS", cfg.RequireDominantColors)
+	cfg.RejectDominantColors = envList("REJECT_DOMINANT_COLORS", cfg.RejectDominantColors)
+	cfg.MinWidth = envInt("MIN_WIDTH", cfg.MinWidth)
+	cfg.MinHeight = envInt("MIN_HEIGHT", cfg.MinHeight)
+	cfg.MinLongEdge = envInt("MIN_LONG_EDGE", cfg.MinLongEdge)
+	cfg.MinShortEdge = envInt("MIN_SHORT_EDGE", cfg.MinShortEdge)
+	cfg.MinMegapixels = envFloat("MIN_MEGAPIXELS", cfg.MinMegapixels)
+	cfg.AspectMin = envFloat("ASPECT_MIN", cfg.AspectMin)
+	cfg.AspectMax = envFloat("ASPECT_MAX", cfg.AspectMax)
+	cfg.BrandConfidenceMax = envFloat("BRAND_CONFIDENCE_MAX", cfg.BrandConfidenceMax)
+	cfg.SubjectClasses = envList("SUBJECT_CLASSES", cfg.SubjectClasses)
+	cfg.SubjectCenterMax = envFloat("SUBJECT_CENTER_MAX", cfg.SubjectCenterMax)
+	cfg.SubjectEdgeMargin = envFloat("SUBJECT_EDGE_MARGIN", cfg.SubjectEdgeMargin)
+	if cfg.SubjectEdgeMargin < 0 || cfg.SubjectEdgeMargin >= 0.5 {
+		log.Fatal("invalid SUBJECT_EDGE_MARGIN ", cfg.SubjectEdgeMargin)
+	}
+	if s := getenv("SCORE"); s != "" {
+		score, err := selector.ParseScoreExpr(s)
+		if err != nil {
+			log.Fatalf("invalid SCORE %q: %v", s, err)
+		}
+		cfg.Score = score
+	}
+	cfg.ScoreMin = envFloat("SCORE_MIN", cfg.ScoreMin)
+	if cfg.AspectMax != 0 && cfg.AspectMax < cfg.AspectMin {
+		log.Fatalf("invalid ASPECT_MAX %v, less than ASPECT_MIN %v", cfg.AspectMax, cfg.AspectMin)
+	}
+
+	if rulesFile := getenv("RULES_FILE"); rulesFile != "" {
+		rules, err := selector.ReadRuleSet(rulesFile)
+		if err != nil {
+			log.Fatal("invalid RULES_FILE ", err)
+		}
+		rules.Apply(&cfg)
+	}
+
+	return cfg
+}
+
+func envString(name string, fallback string) string {
+	if s := getenv(name); s != "" {
+		return s
+	}
+	return fallback
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	s := getenv(name)
+	if s == "" {
+		return fallback
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil || v < 0 {
+		log.Fatalf("invalid %s %q, expected a duration such as 30s", name, s)
+	}
+	return v
+}
+
+func envFloat(name string, fallback float64) float64 {
+	s := getenv(name)
+	if s == "" {
+		return fallback
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		log.Fatal("invalid "+name, err)
+	}
+	return v
+}
+
+func envInt(name string, fallback int) int {
+	s := getenv(name)
+	if s == "" {
+		return fallback
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatal("invalid "+name, err)
+	}
+	return v
+}
+
+func envBool(name string, fallback bool) bool {
+	s := getenv(name)
+	if s == "" {
+		return fallback
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		log.Fatal("invalid "+name, err)
+	}
+	return v
+}
+
+// envList parses a comma-separated list.
+func envList(name string, fallback []string) []string {
+	s := getenv(name)
+	if s == "" {
+		return fallback
+	}
+	return splitList(s)
+}
+
+// splitList splits a comma-separated list, trimming the items and dropping
+// those that are empty.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envFloatMap parses a comma-separated list of key:value pairs.
+func envFloatMap(name string, fallback map[string]float64) map[string]float64 {
+	s := getenv(name)
+	if s == "" {
+		return fallback
+	}
+	m := make(map[string]float64)
+	for _, item := range envList(name, nil) {
+		k, vs, ok := strings.Cut(item, ":")
+		if !ok {
+			log.Fatalf("invalid %s: expected key:value, got %q", name, item)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(vs), 64)
+		if err != nil {
+			log.Fatal("invalid "+name, err)
+		}
+		m[strings.TrimSpace(k)] = v
+	}
+	return m
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// takenAfter and takenBefore bound when photos must have been taken. Zero
+// values leave the range open, and if both are zero dates aren't checked.
+var takenAfter, takenBefore time.Time
+
+// allowUnknownTaken accepts photos whose date taken is unknown rather than
+// rejecting them when a date range is set.
+var allowUnknownTaken bool
+
+// flickrDateLayout is the format of dates in the Flickr API.
+const flickrDateLayout = "2006-01-02 15:04:05"
+
+// PhotoDate is when a photo was taken according to Flickr.
+type PhotoDate struct {
+	Taken time.Time `json:"taken"`
+	// Unknown is set if the photo has no date taken, in which case Flickr
+	// reports the date it was uploaded instead.
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+func loadDateConfig() {
+	takenAfter = envDate("TAKEN_AFTER")
+	takenBefore = envDate("TAKEN_BEFORE")
+	if takenAfter.IsZero() && takenBefore.IsZero() {
+		return
+	}
+	if !takenBefore.IsZero() && !takenBefore.After(takenAfter) {
+		log.Fatal("invalid TAKEN_BEFORE, must be after TAKEN_AFTER")
+	}
+	if flickrAPIKey == "" {
+		flickrAPIKey = getenv("FLICKR_API_KEY")
+	}
+	if flickrAPIKey == "" {
+		log.Fatal("FLICKR_API_KEY not set, required by TAKEN_AFTER and TAKEN_BEFORE")
+	}
+	allowUnknownTaken = envBool("ALLOW_UNKNOWN_DATE", false)
+}
+
+// envDate reads a YYYY-MM-DD date, returning the zero time if name is unset.
+func envDate(name string) time.Time {
+	s := getenv(name)
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		log.Fatalf("invalid %s %q, expected YYYY-MM-DD", name, s)
+	}
+	return t
+}
+
+// checkingDates reports whether photos are filtered by date taken.
+func checkingDates() bool {
+	return !takenAfter.IsZero() || !takenBefore.IsZero()
+}
+
+// dateIssue checks whether a photo taken at date is within TAKEN_AFTER and
+// TAKEN_BEFORE.
+func dateIssue(date PhotoDate) string {
+	if date.Unknown {
+		if allowUnknownTaken {
+			return ""
+		}
+		return "date taken unknown"
+	}
+	if (!takenAfter.IsZero() && date.Taken.Before(takenAfter)) || (!takenBefore.IsZero() && !date.Taken.Before(takenBefore)) {
+		return "taken " + date.Taken.Format(time.DateOnly)
+	}
+	return ""
+}
+
+type flickrInfoResponse struct {
+	Stat    string `json:"stat"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Photo   struct {
+		Dates struct {
+			Taken        string      `json:"taken"`
+			TakenUnknown json.Number `json:"takenunknown"`
+		} `json:"dates"`
+	} `json:"photo"`
+}
+
+// fetchPhotoDate asks the Flickr API when a photo was taken.
+func fetchPhotoDate(photoID string) (PhotoDate, error) {
+	query := url.Values{
+		"method":         {"flickr.photos.getInfo"},
+		"api_key":        {flickrAPIKey},
+		"photo_id":       {photoID},
+		"format":         {"json"},
+		"nojsoncallback": {"1"},
+	}
+	resp, err := flickrAPIGet(query)
+	if err != nil {
+		return PhotoDate{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return PhotoDate{}, fmt.Errorf("Flickr API HTTP status %d", resp.StatusCode)
+	}
+
+	var body flickrInfoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return PhotoDate{}, fmt.Errorf("decode Flickr API response: %w", err)
+	}
+	if body.Stat != "ok" {
+		return PhotoDate{}, fmt.Errorf("Flickr API error %d: %s", body.Code, body.Message)
+	}
+	if body.Photo.Dates.TakenUnknown.String() == "1" {
+		return PhotoDate{Unknown: true}, nil
+	}
+	taken, err := time.Parse(flickrDateLayout, body.Photo.Dates.Taken)
+	if err != nil {
+		return PhotoDate{}, fmt.Errorf("decode Flickr API response: %w", err)
+	}
+	return PhotoDate{Taken: taken}, nil
+}
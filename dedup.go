@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math/bits"
+	"strconv"
+
+	_ "golang.org/x/image/webp"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// dedupSet holds the perceptual hashes of the pictures selected so far, to
+// detect near duplicates among later candidates.
+type dedupSet struct {
+	distance int
+	hashes   map[string]uint64
+}
+
+func newDedupSet(distance int) *dedupSet {
+	return &dedupSet{distance: distance, hashes: make(map[string]uint64)}
+}
+
+// match returns the ID of a selected picture within the Hamming distance
+// threshold of hash, if there is one.
+func (d *dedupSet) match(hash uint64) (string, int, bool) {
+	for id, other := range d.hashes {
+		if dist := bits.OnesCount64(hash ^ other); dist <= d.distance {
+			return id, dist, true
+		}
+	}
+	return "", 0, false
+}
+
+func (d *dedupSet) add(id string, hash uint64) {
+	d.hashes[id] = hash
+}
+
+// encode returns the hashes in the form stored in checkpoints.
+func (d *dedupSet) encode() map[string]string {
+	encoded := make(map[string]string, len(d.hashes))
+	for id, hash := range d.hashes {
+		encoded[id] = formatPHash(hash)
+	}
+	return encoded
+}
+
+func (d *dedupSet) decode(encoded map[string]string) {
+	for id, s := range encoded {
+		if hash, err := parsePHash(s); err == nil {
+			d.hashes[id] = hash
+		}
+	}
+}
+
+func formatPHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func parsePHash(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// errAVIFPreview is returned by fetchPreviewHash for an AVIF preview, which
+// there is no decoder for, so the picture isn't deduplicated.
+var errAVIFPreview = errors.New("AVIF previews can't be hashed")
+
+// fetchPreviewHash downloads the preview image of picture and returns its
+// perceptual hash. JPEG, PNG, GIF and WebP previews can be decoded; AVIF
+// previews return errAVIFPreview and others an error.
+func fetchPreviewHash(ctx context.Context, picture selector.ManifestEntry) (uint64, error) {
+	imageURL := flickrImagePreviewURL(picture)
+	data, err := fetchImage(ctx, imageURL)
+	if err != nil {
+		return 0, err
+	}
+
+	if isAVIF(data) {
+		return 0, errAVIFPreview
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", imageURL, err)
+	}
+	return differenceHash(img), nil
+}
+
+// isAVIF reports whether data is an AVIF image: an ISO media file whose ftyp
+// box gives the avif or avis brand.
+func isAVIF(data []byte) bool {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	brand := string(data[8:12])
+	return brand == "avif" || brand == "avis"
+}
+
+// differenceHash computes the dHash of img: the image is reduced to 9x8
+// grayscale cells and each bit records whether a cell is brighter than its
+// right-hand neighbour.
+func differenceHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	var cells [h][w]float64
+	bounds := img.Bounds()
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/h
+		y1 := max(bounds.Min.Y+(y+1)*bounds.Dy()/h, y0+1)
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/w
+			x1 := max(bounds.Min.X+(x+1)*bounds.Dx()/w, x0+1)
+			sum, n := float64(0), 0
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					n++
+				}
+			}
+			cells[y][x] = sum / float64(n)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
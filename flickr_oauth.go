@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// flickrRESTEndpoint is where Flickr API methods are called.
+const flickrRESTEndpoint = "https://api.flickr.com/services/rest/"
+
+// flickrOAuth holds the credentials Flickr API calls are signed with when
+// FLICKR_OAUTH is set, so that they are made as the user who authorized the
+// token. It is nil for public access.
+var flickrOAuth *flickrCredentials
+
+// flickrCredentials are an OAuth 1.0a consumer, the API key and its secret,
+// and an access token. Flickr's access tokens don't expire, so they are
+// obtained once with the flickr-auth command and kept in a token file.
+type flickrCredentials struct {
+	ConsumerKey    string `json:"-"`
+	ConsumerSecret string `json:"-"`
+	Token          string `json:"token"`
+	TokenSecret    string `json:"tokenSecret"`
+	// Username is who authorized the token, for reference.
+	Username string `json:"username,omitempty"`
+}
+
+func loadFlickrOAuthConfig() {
+	if !envBool("FLICKR_OAUTH", false) {
+		return
+	}
+	consumerKey, consumerSecret := loadFlickrConsumer("FLICKR_OAUTH")
+	tokenFile := flickrTokenFile()
+	data, err := os.ReadFile(tokenFile)
+	if os.IsNotExist(err) {
+		// The token is only missing while being obtained.
+		if len(os.Args) > 1 && os.Args[1] == "flickr-auth" {
+			return
+		}
+		log.Fatalf("FLICKR_OAUTH requires a token in %s, run the flickr-auth command to get one", tokenFile)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	var creds flickrCredentials
+	if err := json.Unmarshal(data, &creds); err != nil || creds.Token == "" || creds.TokenSecret == "" {
+		log.Fatalf("invalid FLICKR_TOKEN_FILE %s, run the flickr-auth command to replace it", tokenFile)
+	}
+	creds.ConsumerKey, creds.ConsumerSecret = consumerKey, consumerSecret
+	flickrOAuth = &creds
+	if flickrAPIKey == "" {
+		flickrAPIKey = consumerKey
+	}
+}
+
+// loadFlickrConsumer reads the API key and secret needed by setting.
+func loadFlickrConsumer(setting string) (string, string) {
+	key, secret := getenv("FLICKR_API_KEY"), getenv("FLICKR_API_SECRET")
+	if key == "" || secret == "" {
+		log.Fatalf("FLICKR_API_KEY and FLICKR_API_SECRET not set, required by %s", setting)
+	}
+	return key, secret
+}
+
+func flickrTokenFile() string {
+	return envString("FLICKR_TOKEN_FILE", ".flickr-token.json")
+}
+
+// flickrAPIGet calls a Flickr API method, signing the call if FLICKR_OAUTH is
+// set.
+func flickrAPIGet(query url.Values) (*http.Response, error) {
+	if flickrOAuth != nil {
+		query = flickrOAuth.sign("GET", flickrRESTEndpoint, query)
+	}
+	return httpClient.Get(flickrRESTEndpoint + "?" + query.Encode())
+}
+
+// sign returns query with the OAuth 1.0a parameters and HMAC-SHA1 signature
+// of a request to endpoint added. Without a token it signs as the consumer
+// alone, as needed to request one.
+func (c *flickrCredentials) sign(method, endpoint string, query url.Values) url.Values {
+	signed := url.Values{}
+	for k, v := range query {
+		signed[k] = slices.Clone(v)
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	signed.Set("oauth_consumer_key", c.ConsumerKey)
+	signed.Set("oauth_nonce", hex.EncodeToString(nonce))
+	signed.Set("oauth_signature_method", "HMAC-SHA1")
+	signed.Set("oauth_timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	signed.Set("oauth_version", "1.0")
+	if c.Token != "" {
+		signed.Set("oauth_token", c.Token)
+	}
+
+	// The signature base string is the method, URL and sorted parameters,
+	// each percent-encoded as RFC 3986 requires.
+	var params []string
+	for k, vs := range signed {
+		for _, v := range vs {
+			params = append(params, oauthEscape(k)+"="+oauthEscape(v))
+		}
+	}
+	slices.Sort(params)
+	base := method + "&" + oauthEscape(endpoint) + "&" + oauthEscape(strings.Join(params, "&"))
+	mac := hmac.New(sha1.New, []byte(oauthEscape(c.ConsumerSecret)+"&"+oauthEscape(c.TokenSecret)))
+	mac.Write([]byte(base))
+	signed.Set("oauth_signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return signed
+}
+
+func oauthEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// flickrOAuthCall makes a signed call to one of Flickr's OAuth endpoints,
+// which answer with form-encoded values.
+func flickrOAuthCall(c *flickrCredentials, endpoint string, query url.Values) (url.Values, error) {
+	resp, err := httpClient.Get(endpoint + "?" + c.sign("GET", endpoint, query).Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Flickr OAuth HTTP status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return url.ParseQuery(string(data))
+}
+
+// flickrOAuthPreviewSizes are the size suffixes that can only be requested
+// with FLICKR_OAUTH, as they are served with a secret of their own that only
+// flickr.photos.getSizes reveals.
+var flickrOAuthPreviewSizes = []string{"h", "k"}
+
+// flickrSizeLabels are the labels flickr.photos.getSizes gives each size
+// suffix.
+var flickrSizeLabels = map[string]string{
+	"s": "Square",
+	"q": "Large Square",
+	"t": "Thumbnail",
+	"m": "Small",
+	"n": "Small 320",
+	"w": "Small 400",
+	"z": "Medium 640",
+	"c": "Medium 800",
+	"b": "Large",
+	"h": "Large 1600",
+	"k": "Large 2048",
+}
+
+// flickrSourceURLs caches the image URL looked up for each photo ID, so that
+// every use of a preview sees the same URL and it's looked up only once.
+var flickrSourceURLs sync.Map
+
+// flickrAuthenticatedPreviewURL returns the URL of photo's preview as seen by
+// the user who authorized FLICKR_OAUTH. The static image hosts don't accept
+// OAuth, but the URLs flickr.photos.getSizes returns to an authenticated call
+// include the secrets needed for private photos and the larger sizes. If the
+// lookup fails the public URL is used.
+func flickrAuthenticatedPreviewURL(photo selector.ManifestEntry) string {
+	public := selector.PreviewURL(photo, flickrImageHost, flickrPreviewSize)
+	if !photo.IsFlickr() || photo.PreviewURL != "" {
+		return public
+	}
+	if cached, ok := flickrSourceURLs.Load(photo.ID); ok {
+		return cached.(string)
+	}
+	source, err := fetchFlickrSourceURL(photo.ID, flickrPreviewSize)
+	if err != nil {
+		warnf("Failed to look up size %s of %s, using public URL: %v", flickrPreviewSize, photo.ID, err)
+		source = public
+	}
+	actual, _ := flickrSourceURLs.LoadOrStore(photo.ID, source)
+	return actual.(string)
+}
+
+type flickrSizesResponse struct {
+	Stat    string `json:"stat"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Sizes   struct {
+		Size []struct {
+			Label  string `json:"label"`
+			Source string `json:"source"`
+		} `json:"size"`
+	} `json:"sizes"`
+}
+
+// fetchFlickrSourceURL looks up the URL of a photo's image of the given size,
+// served from FLICKR_IMAGE_HOST.
+func fetchFlickrSourceURL(photoID, size string) (string, error) {
+	query := url.Values{
+		"method":         {"flickr.photos.getSizes"},
+		"api_key":        {flickrAPIKey},
+		"photo_id":       {photoID},
+		"format":         {"json"},
+		"nojsoncallback": {"1"},
+	}
+	resp, err := flickrAPIGet(query)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Flickr API HTTP status %d", resp.StatusCode)
+	}
+
+	var body flickrSizesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode Flickr API response: %w", err)
+	}
+	if body.Stat != "ok" {
+		return "", fmt.Errorf("Flickr API error %d: %s", body.Code, body.Message)
+	}
+	for _, s := range body.Sizes.Size {
+		if s.Label != flickrSizeLabels[size] {
+			continue
+		}
+		source, err := url.Parse(s.Source)
+		if err != nil {
+			return "", fmt.Errorf("decode Flickr API response: %w", err)
+		}
+		source.Host = flickrImageHost
+		return source.String(), nil
+	}
+	return "", fmt.Errorf("size not available")
+}
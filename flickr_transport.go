@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// defaultUserAgent identifies the selector to Flickr unless USER_AGENT is set.
+const defaultUserAgent = "contourguessr-subject-selector (+https://github.com/dzfranklin/contourguessr-subject-selector)"
+
+// flickrTransport sends requests to Flickr with a descriptive User-Agent.
+// Other requests pass through unchanged.
+type flickrTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *flickrTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if !isFlickrHost(host) {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(req)
+}
+
+// isFlickrHost reports whether requests to host go to Flickr, including its
+// image hosts and FLICKR_IMAGE_HOST.
+func isFlickrHost(host string) bool {
+	return host == "flickr.com" || strings.HasSuffix(host, ".flickr.com") || isFlickrImageHost(host)
+}
+
+// isFlickrImageHost reports whether host serves Flickr images, such as
+// live.staticflickr.com or FLICKR_IMAGE_HOST.
+func isFlickrImageHost(host string) bool {
+	return strings.HasSuffix(host, ".staticflickr.com") || host == flickrImageHost
+}
+
+// loadFlickrTransport sets up the User-Agent and limits of requests to Flickr,
+// once FLICKR_IMAGE_HOST is known.
+func loadFlickrTransport() {
+	t := &flickrTransport{
+		base:      httpClient.Transport,
+		userAgent: envString("USER_AGENT", defaultUserAgent),
+	}
+	if t.base == nil {
+		t.base = http.DefaultTransport
+	}
+	httpClient.Transport = &hostLimitTransport{base: t}
+
+	rateLimit := envFloat("FLICKR_IMAGE_RATE_LIMIT", 300)
+	if rateLimit < 0 {
+		log.Fatal("invalid FLICKR_IMAGE_RATE_LIMIT ", rateLimit)
+	}
+	concurrency := envInt("FLICKR_IMAGE_CONCURRENCY", 8)
+	if concurrency < 0 {
+		log.Fatal("invalid FLICKR_IMAGE_CONCURRENCY ", concurrency)
+	}
+	hostLimits[flickrImageHost] = newHostLimit(concurrency, rateLimit)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// flickrAPIKey is needed to look up photo locations when REGION_BOUNDS is set.
+var flickrAPIKey string
+
+// regionBounds maps each region to the polygon its photos must have been
+// taken in. Regions without bounds are not filtered by location.
+var regionBounds map[string][][2]float64
+
+// allowMissingLocation accepts photos that are not geotagged rather than
+// rejecting them when their region has bounds.
+var allowMissingLocation bool
+
+// PhotoLocation is where a photo was taken according to Flickr.
+type PhotoLocation struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+	// Missing is set, and Lat and Lng are zero, if the photo isn't geotagged.
+	Missing bool `json:"missing,omitempty"`
+}
+
+func loadGeoConfig() {
+	boundsFile := getenv("REGION_BOUNDS")
+	if boundsFile == "" {
+		return
+	}
+	data, err := os.ReadFile(boundsFile)
+	if err != nil {
+		log.Fatal("invalid REGION_BOUNDS ", err)
+	}
+	if err := json.Unmarshal(data, &regionBounds); err != nil {
+		log.Fatal("invalid REGION_BOUNDS ", err)
+	}
+	for region, polygon := range regionBounds {
+		if len(polygon) < 3 {
+			log.Fatalf("invalid REGION_BOUNDS: polygon for %s has fewer than 3 points", region)
+		}
+	}
+
+	flickrAPIKey = getenv("FLICKR_API_KEY")
+	if flickrAPIKey == "" {
+		log.Fatal("FLICKR_API_KEY not set, required by REGION_BOUNDS")
+	}
+	allowMissingLocation = envBool("ALLOW_MISSING_LOCATION", false)
+}
+
+// locationIssue checks whether location is within the bounds of region.
+func locationIssue(region string, location PhotoLocation) string {
+	if location.Missing {
+		if allowMissingLocation {
+			return ""
+		}
+		return "not geotagged"
+	}
+	if !pointInPolygon(location.Lng, location.Lat, regionBounds[region]) {
+		return fmt.Sprintf("outside region (%.4f, %.4f)", location.Lat, location.Lng)
+	}
+	return ""
+}
+
+// pointInPolygon reports whether (x, y) is inside polygon, given as [x, y]
+// vertices, by counting how many edges a ray from the point crosses.
+func pointInPolygon(x, y float64, polygon [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		xi, yi := polygon[i][0], polygon[i][1]
+		xj, yj := polygon[j][0], polygon[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// flickrNotGeotaggedCode is the error code flickr.photos.geo.getLocation
+// returns for a photo without location information.
+const flickrNotGeotaggedCode = 2
+
+type flickrGeoResponse struct {
+	Stat    string `json:"stat"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Photo   struct {
+		Location struct {
+			Latitude  json.Number `json:"latitude"`
+			Longitude json.Number `json:"longitude"`
+		} `json:"location"`
+	} `json:"photo"`
+}
+
+// fetchPhotoLocation asks the Flickr API where a photo was taken.
+func fetchPhotoLocation(photoID string) (PhotoLocation, error) {
+	query := url.Values{
+		"method":         {"flickr.photos.geo.getLocation"},
+		"api_key":        {flickrAPIKey},
+		"photo_id":       {photoID},
+		"format":         {"json"},
+		"nojsoncallback": {"1"},
+	}
+	resp, err := flickrAPIGet(query)
+	if err != nil {
+		return PhotoLocation{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return PhotoLocation{}, fmt.Errorf("Flickr API HTTP status %d", resp.StatusCode)
+	}
+
+	var body flickrGeoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return PhotoLocation{}, fmt.Errorf("decode Flickr API response: %w", err)
+	}
+	if body.Stat != "ok" {
+		if body.Code == flickrNotGeotaggedCode {
+			return PhotoLocation{Missing: true}, nil
+		}
+		return PhotoLocation{}, fmt.Errorf("Flickr API error %d: %s", body.Code, body.Message)
+	}
+
+	lat, err := strconv.ParseFloat(body.Photo.Location.Latitude.String(), 64)
+	if err != nil {
+		return PhotoLocation{}, fmt.Errorf("decode Flickr API response: %w", err)
+	}
+	lng, err := strconv.ParseFloat(body.Photo.Location.Longitude.String(), 64)
+	if err != nil {
+		return PhotoLocation{}, fmt.Errorf("decode Flickr API response: %w", err)
+	}
+	return PhotoLocation{Lat: lat, Lng: lng}, nil
+}
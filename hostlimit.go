@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// hostLimit bounds the requests to a remote host, which each have limits of
+// their own: Azure is expensive and strictly limited, while Flickr's image
+// hosts can take more in parallel.
+type hostLimit struct {
+	// sem, if not nil, holds a slot for each request in flight until its
+	// response body is closed.
+	sem chan struct{}
+	// limiter, if not nil, paces the requests, and jitter is the most each is
+	// delayed beyond that at random, so that workers don't fall into
+	// lockstep.
+	limiter *rate.Limiter
+	jitter  time.Duration
+}
+
+// newHostLimit returns a limit of concurrency requests in flight and
+// perMinute requests a minute, either of which may be zero for no limit.
+func newHostLimit(concurrency int, perMinute float64) *hostLimit {
+	l := &hostLimit{}
+	if concurrency > 0 {
+		l.sem = make(chan struct{}, concurrency)
+	}
+	if perMinute > 0 {
+		// A burst of one spaces requests out evenly instead of spending the
+		// whole quota at the start of each minute.
+		l.limiter = rate.NewLimiter(rate.Limit(perMinute/60), 1)
+		l.jitter = time.Duration(float64(time.Minute) / perMinute / 10)
+	}
+	return l
+}
+
+// acquire waits until a request may be sent, returning a function to call
+// once it is done.
+func (l *hostLimit) acquire(ctx context.Context) (release func(), err error) {
+	release = func() {}
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		var once sync.Once
+		release = func() { once.Do(func() { <-l.sem }) }
+	}
+	if l.limiter != nil {
+		if err := l.limiter.Wait(ctx); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	if l.jitter > 0 {
+		select {
+		case <-time.After(rand.N(l.jitter)):
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+// hostLimits are the limits of each host by name. They are set up with the
+// configuration and only read afterwards.
+var hostLimits = make(map[string]*hostLimit)
+
+// hostLimitFor returns the limit of requests to host, or nil if there is none.
+// Every Flickr image host shares the limit of FLICKR_IMAGE_HOST.
+func hostLimitFor(host string) *hostLimit {
+	if l, ok := hostLimits[host]; ok {
+		return l
+	}
+	if isFlickrImageHost(host) {
+		return hostLimits[flickrImageHost]
+	}
+	return nil
+}
+
+// hostLimitTransport applies the limit of each request's host.
+type hostLimitTransport struct {
+	base http.RoundTripper
+}
+
+func (t *hostLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	l := hostLimitFor(req.URL.Hostname())
+	if l == nil {
+		return t.base.RoundTrip(req)
+	}
+	release, err := l.acquire(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody releases a request's slot once its response has been read.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// httpClient sends the requests to Azure and Flickr. It is the selector
+// package's client, so that the timeout set by HTTP_TIMEOUT applies to both
+// and a hung connection can't stall a run.
+var httpClient = selector.HTTPClient
+
+// analysisTimeout bounds the time taken to analyze a single image, including
+// any retries.
+var analysisTimeout = 5 * time.Minute
+
+// imageFetchMaxBytes is the largest image fetchImage will download, set by
+// IMAGE_FETCH_MAX_BYTES.
+var imageFetchMaxBytes int64 = 20 << 20
+
+// imageFetchRetries is how many times a failed image download is retried, and
+// imageFetchRetryDelay the delay before the first retry, doubling after each.
+var imageFetchRetries = 2
+var imageFetchRetryDelay = time.Second
+
+func loadHTTPConfig() {
+	loadProxy()
+	httpClient.Timeout = envDuration("HTTP_TIMEOUT", httpClient.Timeout)
+	analysisTimeout = envDuration("ANALYSIS_TIMEOUT", analysisTimeout)
+	imageFetchMaxBytes = int64(envInt("IMAGE_FETCH_MAX_BYTES", int(imageFetchMaxBytes)))
+	if imageFetchMaxBytes < 1 {
+		log.Fatal("invalid IMAGE_FETCH_MAX_BYTES ", imageFetchMaxBytes)
+	}
+}
+
+// loadProxy gives httpClient a transport of its own that sends every request
+// through PROXY_URL, if it is set, or else through the proxies HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY choose for each.
+func loadProxy() {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy := getenv("PROXY_URL"); proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			log.Fatalf("invalid PROXY_URL %q, expected a URL", proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			log.Fatalf("invalid PROXY_URL %q, expected an http, https or socks5 URL", u.Redacted())
+		}
+		transport.Proxy = http.ProxyURL(u)
+	} else {
+		// The environment, .env files and config file have all been loaded
+		// into the process's environment by now, where the standard proxy
+		// settings are read from. Looking them up here reports them.
+		for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"} {
+			getenv(name)
+		}
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	httpClient.Transport = transport
+}
+
+// errImageNotRetryable marks image download failures that would fail the
+// same way again.
+var errImageNotRetryable = errors.New("not retryable")
+
+// fetchImage returns the contents of the image at imageURL, reading local
+// images from disk. Every download of an image goes through here, so that
+// each is bounded by HTTP_TIMEOUT and IMAGE_FETCH_MAX_BYTES, and one cut short
+// by a flaky connection or failing with a 429 or 5xx status is retried,
+// continuing from where it was cut short if the server allows. Cancelling ctx
+// stops the download, including while waiting to retry.
+func fetchImage(ctx context.Context, imageURL string) ([]byte, error) {
+	if path, ok := selector.LocalImagePath(imageURL); ok {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readImage(f, imageURL, nil)
+	}
+
+	var partial partialImage
+	delay := imageFetchRetryDelay
+	for attempt := 0; ; attempt++ {
+		data, err := downloadImage(ctx, imageURL, &partial)
+		if err == nil {
+			return data, nil
+		}
+		if errors.Is(err, errImageNotRetryable) || attempt >= imageFetchRetries || ctx.Err() != nil {
+			return nil, err
+		}
+		if partial.resumable() {
+			detailf("Fetching %s failed after %d bytes, resuming in %s: %v", imageURL, len(partial.data), delay, err)
+		} else {
+			detailf("Fetching %s failed, retrying in %s: %v", imageURL, delay, err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// partialImage is what has been received of an image whose download was cut
+// short, with the validator, its ETag or Last-Modified time, that a Range
+// request continuing it sends in If-Range so that the server only sends the
+// rest if the image is unchanged.
+type partialImage struct {
+	data      []byte
+	validator string
+}
+
+func (p *partialImage) resumable() bool {
+	return len(p.data) > 0 && p.validator != ""
+}
+
+// downloadImage requests the image at imageURL, or the rest of it if partial
+// can be resumed, recording in partial what is received if it is cut short.
+func downloadImage(ctx context.Context, imageURL string, partial *partialImage) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resuming := partial.resumable()
+	if resuming {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(partial.data)))
+		req.Header.Set("If-Range", partial.validator)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	received := partial.data
+	switch {
+	case resuming && resp.StatusCode == http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", len(received))) {
+			*partial = partialImage{}
+			return nil, fmt.Errorf("%s: unexpected Content-Range %q", imageURL, resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == http.StatusOK:
+		// The whole image is sent, because it isn't being resumed, the server
+		// doesn't support ranges or the image has changed.
+		received = nil
+	default:
+		err := fmt.Errorf("%s: HTTP status %d", imageURL, resp.StatusCode)
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			err = fmt.Errorf("%w (%w)", err, errImageNotRetryable)
+		}
+		return nil, err
+	}
+	if resp.ContentLength > imageFetchMaxBytes-int64(len(received)) {
+		return nil, fmt.Errorf("%s: %d bytes is larger than IMAGE_FETCH_MAX_BYTES (%w)", imageURL, int64(len(received))+resp.ContentLength, errImageNotRetryable)
+	}
+
+	data, err := readImage(resp.Body, imageURL, received)
+	if err != nil {
+		validator := resp.Header.Get("ETag")
+		if validator == "" || strings.HasPrefix(validator, "W/") {
+			validator = resp.Header.Get("Last-Modified")
+		}
+		*partial = partialImage{data: data, validator: validator}
+		return nil, err
+	}
+	return data, nil
+}
+
+// readImage appends to received the rest of an image of at most
+// IMAGE_FETCH_MAX_BYTES in all read from r. A body that ends before its
+// Content-Length is reported as io.ErrUnexpectedEOF, along with what was read
+// of it.
+func readImage(r io.Reader, imageURL string, received []byte) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, imageFetchMaxBytes-int64(len(received))+1))
+	received = append(received, data...)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = fmt.Errorf("%w (%w)", err, errImageNotRetryable)
+		}
+		return received, fmt.Errorf("%s: %w", imageURL, err)
+	}
+	if int64(len(received)) > imageFetchMaxBytes {
+		return nil, fmt.Errorf("%s: larger than IMAGE_FETCH_MAX_BYTES (%w)", imageURL, errImageNotRetryable)
+	}
+	return received, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// jsonLogs is set when LOG_FORMAT=json. Plain log.Printf output is then
+// routed through slog too, so every line is structured.
+var jsonLogs bool
+
+// logLevel is how much is logged.
+type logLevel int
+
+const (
+	// quietLogs logs only summaries and warnings.
+	quietLogs logLevel = iota
+	// normalLogs also logs each picture and request.
+	normalLogs
+	// verboseLogs also logs the analysis of each picture.
+	verboseLogs
+)
+
+// verbosity is set by LOG_LEVEL.
+var verbosity = normalLogs
+
+// explainDecisions logs every check made in categorizing each picture, set
+// by EXPLAIN.
+var explainDecisions bool
+
+func setupLogging() {
+	switch level := getenv("LOG_LEVEL"); level {
+	case "", "normal":
+		verbosity = normalLogs
+	case "quiet":
+		verbosity = quietLogs
+	case "verbose":
+		verbosity = verboseLogs
+	default:
+		log.Fatalf("invalid LOG_LEVEL %q, expected quiet, normal or verbose", level)
+	}
+
+	explainDecisions = envBool("EXPLAIN", false)
+
+	switch format := getenv("LOG_FORMAT"); format {
+	case "", "text":
+	case "json":
+		jsonLogs = true
+		opts := &slog.HandlerOptions{}
+		if verbosity >= verboseLogs {
+			opts.Level = slog.LevelDebug
+		}
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		log.Fatalf("invalid LOG_FORMAT %q, expected text or json", format)
+	}
+}
+
+// infof logs a summary, which is logged at every LOG_LEVEL.
+func infof(format string, args ...any) {
+	log.Printf(format, args...)
+}
+
+// detailf logs a detail of the run, such as a request, that is left out by
+// LOG_LEVEL=quiet.
+func detailf(format string, args ...any) {
+	if verbosity >= normalLogs {
+		log.Printf(format, args...)
+	}
+}
+
+// warnf logs a problem that doesn't stop the run.
+func warnf(format string, args ...any) {
+	if jsonLogs {
+		slog.Warn(fmt.Sprintf(format, args...))
+	} else {
+		log.Print("WARNING: " + fmt.Sprintf(format, args...))
+	}
+}
+
+// logRegionf logs a message about the processing of region.
+func logRegionf(region string, format string, args ...any) {
+	if jsonLogs {
+		slog.Info(fmt.Sprintf(format, args...), "region", region)
+	} else {
+		log.Print(regionPrefix(region) + fmt.Sprintf(format, args...))
+	}
+}
+
+// warnRegionf logs a warning about the processing of region.
+func warnRegionf(region string, format string, args ...any) {
+	if jsonLogs {
+		slog.Warn(fmt.Sprintf(format, args...), "region", region)
+	} else {
+		log.Print(regionPrefix(region) + "WARNING: " + fmt.Sprintf(format, args...))
+	}
+}
+
+// regionPrefix distinguishes the text log lines of regions processed
+// concurrently.
+func regionPrefix(region string) string {
+	if regionConcurrency > 1 {
+		return "[" + region + "] "
+	}
+	return ""
+}
+
+// logImage logs the outcome of processing a single picture. status is one of
+// "OK", "NG", "SKIP" (passed but not selected for reasons other than
+// quality) or "ERR", and detail explains a rejection, skip or error.
+func logImage(region string, status string, okCount int, picture selector.ManifestEntry, detail string) {
+	if verbosity < normalLogs && status != "ERR" {
+		return
+	}
+	webURL := selector.WebURL(picture)
+	if jsonLogs {
+		level := slog.LevelInfo
+		if status == "ERR" {
+			level = slog.LevelWarn
+		}
+		attrs := []any{
+			"region", region,
+			"photoId", picture.ID,
+			"okCount", okCount,
+			"targetCount", regionTarget(region),
+			"webUrl", webURL,
+			"title", picture.Title,
+		}
+		if detail != "" {
+			attrs = append(attrs, "detail", detail)
+		}
+		slog.Log(context.Background(), level, status, attrs...)
+		return
+	}
+
+	if detail == "" {
+		log.Printf("%s%d/%d %s %s %s", regionPrefix(region), okCount, regionTarget(region), status, webURL, picture.Title)
+	} else {
+		log.Printf("%s%d/%d %s %s %s: %s", regionPrefix(region), okCount, regionTarget(region), status, webURL, picture.Title, detail)
+	}
+}
+
+// logImageExplanation logs each check made in categorizing a picture with
+// EXPLAIN, with the parts of combined rules indented beneath them. Outside
+// SELECTION=first only the checks that rule a picture out are made.
+func logImageExplanation(region string, picture selector.ManifestEntry, analysis selector.ImageAnalysis) {
+	if !explainDecisions {
+		return
+	}
+	var checks []selector.Check
+	if selectionMode == "first" {
+		checks = selector.Explain(picture, analysis, categorizeConfig)
+	} else {
+		checks = selector.ExplainContent(picture, analysis, categorizeConfig)
+	}
+	explained := make([]string, len(checks))
+	for i, check := range checks {
+		explained[i] = strings.Repeat("  ", check.Depth) + check.String()
+	}
+	if jsonLogs {
+		slog.Info("explanation", "region", region, "photoId", picture.ID, "checks", explained)
+		return
+	}
+	for _, line := range explained {
+		log.Printf("%sExplain %s: %s", regionPrefix(region), picture.ID, line)
+	}
+}
+
+// logImageAnalysis logs the whole analysis of a picture with
+// LOG_LEVEL=verbose.
+func logImageAnalysis(region string, picture selector.ManifestEntry, analysis selector.ImageAnalysis) {
+	if verbosity < verboseLogs {
+		return
+	}
+	if jsonLogs {
+		slog.Debug("analysis", "region", region, "photoId", picture.ID, "analysis", analysis)
+		return
+	}
+	data, err := json.Marshal(analysis)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%sAnalysis of %s: %s", regionPrefix(region), picture.ID, data)
+}
@@ -1,317 +1,1418 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
-	"net/url"
+	"math"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/joho/godotenv"
+	"contourguessr-subject-selector/selector"
 )
 
-var azureEndpoint string
-var azureKey string
+var visionProvider selector.VisionProvider
+
+// secondaryProvider, if set, analyzes the pictures that pass with the
+// analyses of visionProvider, which are only selected if they pass with its
+// analyses too.
+var secondaryProvider selector.VisionProvider
+
+// regionProviders are the providers of the regions analyzed with an Azure
+// resource of their own, set by REGION_AZURE_ENDPOINTS.
+var regionProviders map[string]selector.VisionProvider
 var targetCount int
+var regionTargets map[string]int
+var concurrency int
+var regionConcurrency int
+var dryRun bool
+var flickrPreviewSize string
+var flickrImageHost string
+var outputFormat string
+var outputChunkSize int
+var selectionMode string
+var dedupDistance int
+var maxPerOwner int
+var retryFailed bool
 
-func init() {
-	err := godotenv.Load(".env", ".local.env")
-	if err != nil {
-		log.Fatal("Error loading .env file", err)
-	}
+// reanalyzeIDs are the pictures whose cached analyses are ignored, and
+// reanalyzeAll ignores every cached analysis, as set by REANALYZE.
+var reanalyzeIDs map[string]bool
+var reanalyzeAll bool
 
-	azureEndpoint = os.Getenv("AZURE_ENDPOINT")
-	if azureEndpoint == "" {
-		log.Fatal("AZURE_ENDPOINT not set")
-	}
+var repairAnalyses bool
+var manifestsDir string
+var analysesDir string
+var outDir string
+var sortManifest bool
+var shuffleSeed int
+var incremental bool
+var keepStaleAnalyses bool
+var reanalyzeChangedURL bool
+var maxRuntime time.Duration
+var maxProcessed int
+var randomPool int
+var randomWeighted bool
+var randomSeed int
+var onlyRegions []string
+var categorizeConfig selector.CategorizeConfig
 
-	azureKey = os.Getenv("AZURE_KEY")
-	if azureKey == "" {
-		log.Fatal("AZURE_KEY not set")
-	}
+// healthCheck checks the vision provider before a run, metricsAddr is where
+// metrics are served, if anywhere, and manifestURLs are manifests fetched in
+// addition to those in MANIFESTS_DIR. emptyManifest is what to do with a
+// manifest with no entries: skip its region, write its empty output or fail.
+var healthCheck bool
+var metricsAddr string
+var manifestURLs []string
+var emptyManifest string
 
-	targetCountS := os.Getenv("TARGET_COUNT")
+// loadConfig reads the settings of the run from the environment, the .env
+// files and the config file. It is called by main rather than from init so
+// that tests don't need a configured environment.
+func loadConfig() {
+	loadEnvironment()
+
+	setupLogging()
+	setupProgress()
+	loadHTTPConfig()
+
+	visionProvider = loadVisionProvider()
+	secondaryProvider = loadSecondaryProvider()
+	regionProviders = loadRegionProviders(visionProvider)
+
+	targetCountS := getenv("TARGET_COUNT")
 	if targetCountS == "" {
 		log.Fatal("TARGET_COUNT not set")
 	}
+	var err error
 	targetCount, err = strconv.Atoi(targetCountS)
 	if err != nil {
 		log.Fatal("invalid TARGET_COUNT", err)
 	}
+	loadRegionTargets()
+
+	concurrency = envInt("CONCURRENCY", 4)
+	if concurrency < 1 {
+		log.Fatal("invalid CONCURRENCY ", concurrency)
+	}
+
+	regionConcurrency = envInt("REGION_CONCURRENCY", 1)
+	if regionConcurrency < 1 {
+		log.Fatal("invalid REGION_CONCURRENCY ", regionConcurrency)
+	}
+
+	dryRun = envBool("DRY_RUN", false)
+
+	onlyRegions = envList("REGION", nil)
+
+	manifestsDir = envString("MANIFESTS_DIR", "ingest_manifests")
+	analysesDir = envString("ANALYSES_DIR", "analyses")
+	outDir = envString("OUT_DIR", "out")
+
+	cacheBackend = envString("CACHE_BACKEND", "ndjson")
+	if cacheBackend != "ndjson" && cacheBackend != "sqlite" {
+		log.Fatalf("invalid CACHE_BACKEND %q, expected ndjson or sqlite", cacheBackend)
+	}
+	sharedCache = envBool("SHARED_CACHE", false)
+
+	maxAPICalls := envInt("MAX_API_CALLS", -1)
+	if maxAPICalls < -1 {
+		log.Fatal("invalid MAX_API_CALLS ", maxAPICalls)
+	}
+	apiCallsRemaining.Store(int64(maxAPICalls))
+
+	flickrPreviewSize = getenv("FLICKR_PREVIEW_SIZE")
+	if flickrPreviewSize == "" {
+		flickrPreviewSize = "w"
+	}
+	previewSizes := selector.FlickrPreviewSizes
+	if envBool("FLICKR_OAUTH", false) {
+		previewSizes = append(slices.Clone(previewSizes), flickrOAuthPreviewSizes...)
+	}
+	if !slices.Contains(previewSizes, flickrPreviewSize) {
+		log.Fatalf("invalid FLICKR_PREVIEW_SIZE %q, expected one of %s", flickrPreviewSize, strings.Join(previewSizes, ", "))
+	}
+
+	flickrImageHost = envString("FLICKR_IMAGE_HOST", selector.FlickrImageHost)
+	if strings.ContainsAny(flickrImageHost, "/?#") {
+		log.Fatalf("invalid FLICKR_IMAGE_HOST %q, expected a host name", flickrImageHost)
+	}
+	loadFlickrTransport()
+
+	outputChunkSize = envInt("OUTPUT_CHUNK_SIZE", 0)
+	if outputChunkSize < 0 {
+		log.Fatal("invalid OUTPUT_CHUNK_SIZE ", outputChunkSize)
+	}
+
+	outputFormat = getenv("OUTPUT_FORMAT")
+	switch outputFormat {
+	case "":
+		outputFormat = "id"
+	case "id", "verbose", "csv":
+	default:
+		log.Fatalf("invalid OUTPUT_FORMAT %q, expected id, verbose or csv", outputFormat)
+	}
+
+	selectionMode = getenv("SELECTION")
+	switch selectionMode {
+	case "":
+		selectionMode = "first"
+	case "first", "top", "random":
+	default:
+		log.Fatalf("invalid SELECTION %q, expected first, top or random", selectionMode)
+	}
+
+	randomPool = envInt("RANDOM_POOL", 0)
+	if randomPool < 0 {
+		log.Fatal("invalid RANDOM_POOL ", randomPool)
+	}
+	randomWeighted = envBool("RANDOM_WEIGHTED", false)
+	randomSeed = -1
+	if getenv("RANDOM_SEED") != "" {
+		randomSeed = envInt("RANDOM_SEED", 0)
+		if randomSeed < 0 {
+			log.Fatal("invalid RANDOM_SEED ", randomSeed)
+		}
+	}
+
+	dedupDistance = -1
+	if envBool("DEDUP", false) {
+		dedupDistance = envInt("DEDUP_DISTANCE", 6)
+		if dedupDistance < 0 || dedupDistance > 64 {
+			log.Fatal("invalid DEDUP_DISTANCE ", dedupDistance)
+		}
+	}
+
+	retryFailed = envBool("RETRY_FAILED", false)
+	repairAnalyses = envBool("REPAIR_ANALYSES", false)
+	keepStaleAnalyses = envBool("KEEP_STALE_ANALYSES", false)
+	reanalyzeChangedURL = envBool("REANALYZE_CHANGED_URL", false)
+	for _, id := range envList("REANALYZE", nil) {
+		if id == "all" {
+			reanalyzeAll = true
+		} else {
+			if reanalyzeIDs == nil {
+				reanalyzeIDs = make(map[string]bool)
+			}
+			reanalyzeIDs[id] = true
+		}
+	}
+	maxRuntime = envDuration("MAX_RUNTIME", 0)
+	reviewMode = envBool("REVIEW", false)
+
+	completionWebhook = getenv("COMPLETION_WEBHOOK")
+
+	maxProcessed = envInt("MAX_PROCESSED", 0)
+	if maxProcessed < 0 {
+		log.Fatal("invalid MAX_PROCESSED ", maxProcessed)
+	}
+
+	maxPerOwner = envInt("MAX_PER_OWNER", 0)
+	if maxPerOwner < 0 {
+		log.Fatal("invalid MAX_PER_OWNER ", maxPerOwner)
+	}
+
+	sort := getenv("SORT")
+	switch sort {
+	case "":
+	case "id":
+		sortManifest = true
+	default:
+		log.Fatalf("invalid SORT %q, expected id", sort)
+	}
+
+	shuffleSeed = -1
+	if envBool("SHUFFLE", false) {
+		shuffleSeed = envInt("SHUFFLE_SEED", 0)
+		if shuffleSeed < 0 {
+			log.Fatal("invalid SHUFFLE_SEED ", shuffleSeed)
+		}
+	}
+
+	incremental = envBool("INCREMENTAL", false)
+	if incremental && selectionMode != "first" {
+		log.Fatal("INCREMENTAL requires SELECTION=first")
+	}
+
+	loadFlickrOAuthConfig()
+	loadGeoConfig()
+	loadTopUpConfig()
+	loadDateConfig()
+	loadOwnerLists()
+	loadTextConfig()
+
+	categorizeConfig = loadCategorizeConfig()
+
+	healthCheck = envBool("HEALTH_CHECK", true)
+	metricsAddr = getenv("METRICS_ADDR")
+	manifestURLs = envList("MANIFEST_URLS", nil)
+	emptyManifest = getenv("EMPTY_MANIFEST")
+	switch emptyManifest {
+	case "":
+		emptyManifest = "skip"
+	case "skip", "write", "fail":
+	default:
+		log.Fatalf("invalid EMPTY_MANIFEST %q, expected skip, write or fail", emptyManifest)
+	}
+	reportSettings()
 }
 
 func main() {
-	manifestFiles, err := os.ReadDir("ingest_manifests")
-	if err != nil {
-		log.Fatal(err)
+	loadConfig()
+
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
 	}
-	manifests := make(map[string][]ManifestEntry)
-	for _, manifestFile := range manifestFiles {
-		entries, err := parseManifestFile("ingest_manifests/" + manifestFile.Name())
-		if err != nil {
-			log.Fatal(err)
+	runRegions()
+}
+
+// runRegions selects pictures from the manifest of every region, or just
+// those named by REGION.
+func runRegions() {
+	manifestPaths := selectManifests(listManifests(), onlyRegions)
+	emptyManifests := findEmptyManifests(manifestPaths)
+
+	// The first interrupt lets each region finish its current image and shut
+	// down cleanly. Further interrupts are left to kill the process.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stopSignals()
+	}()
+	// Reaching MAX_RUNTIME shuts down the same way.
+	if maxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxRuntime)
+		defer cancel()
+	}
+
+	// Fail before touching any output if the provider is misconfigured.
+	if !dryRun && healthCheck {
+		if err := visionProvider.Check(ctx); err != nil {
+			log.Fatalf("Vision provider health check failed: %v", err)
 		}
-		name := strings.TrimSuffix(manifestFile.Name(), ".json")
-		manifests[name] = entries
+		for _, manifestPath := range manifestPaths {
+			region := selector.ManifestRegion(manifestPath)
+			if p, ok := regionProviders[region]; ok {
+				if err := p.Check(ctx); err != nil {
+					log.Fatalf("Vision provider health check for region %s failed: %v", region, err)
+				}
+			}
+		}
+		if secondaryProvider != nil {
+			if err := secondaryProvider.Check(ctx); err != nil {
+				log.Fatalf("Secondary vision provider health check failed: %v", err)
+			}
+		}
+	}
+
+	stopMetrics := func() {}
+	if metricsAddr != "" {
+		stopMetrics = startMetricsServer(metricsAddr)
 	}
 
-	if err := os.MkdirAll("analyses", 0750); err != nil {
+	if err := os.MkdirAll(analysesDir, 0750); err != nil {
 		log.Fatal(err)
 	}
-	if err := os.MkdirAll("out", 0750); err != nil {
+	if err := os.MkdirAll(outDir, 0750); err != nil {
 		log.Fatal(err)
 	}
 
-	for region, manifest := range manifests {
-		processRegion(region, manifest)
+	summary := newRunSummary()
+	sem := make(chan struct{}, regionConcurrency)
+	var wg sync.WaitGroup
+	for _, manifestPath := range manifestPaths {
+		region := selector.ManifestRegion(manifestPath)
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		// Regions topped up from Flickr can still find pictures without a
+		// manifest.
+		if emptyManifests[manifestPath] && emptyManifest == "skip" && !(flickrTopUp && regionBounds[region] != nil) {
+			target := regionTarget(region)
+			warnRegionf(region, "Skipping region %s, leaving any earlier output in place", region)
+			summary.add(region, RegionSummary{Target: target, Shortfall: target, EmptyManifest: true, Rejections: make(map[string]int)})
+			<-sem
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r := processRegion(ctx, region, manifestPath, regionTarget(region))
+			r.EmptyManifest = emptyManifests[manifestPath]
+			summary.add(region, r)
+		}()
+	}
+	wg.Wait()
+	stopMetrics()
+	interrupted := ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded)
+	summary.ExitCode = summary.exitCode(interrupted)
+	summary.write(filepath.Join(outDir, "run-summary.json"))
+	if len(manifestPaths) > 1 && summary.Total.CacheHits+summary.Total.CacheMisses > 0 {
+		infof("Cache across every region: %s", formatCacheCounts(summary.Total.CacheHits, summary.Total.CacheMisses))
+	}
+
+	switch summary.ExitCode {
+	case exitInterrupted:
+		infof("Interrupted")
+	case exitErrors:
+		warnf("Entries were skipped due to errors in %s", strings.Join(summary.erroredRegions(), ", "))
+	case exitStopped:
+		infof("Stopped after reaching MAX_RUNTIME of %s, run again to continue", maxRuntime)
+	case exitShortfall:
+		warnf("Regions short of their target: %s", strings.Join(summary.shortRegions(), ", "))
+	}
+	if summary.ExitCode != exitOK {
+		os.Exit(summary.ExitCode)
 	}
 }
 
-func processRegion(region string, manifest []ManifestEntry) {
-	log.Printf("Processing region %s", region)
+// findEmptyManifests returns the manifests of manifestPaths that have no
+// entries, warning about each, or fails if EMPTY_MANIFEST=fail.
+func findEmptyManifests(manifestPaths []string) map[string]bool {
+	empty := make(map[string]bool)
+	for _, manifestPath := range manifestPaths {
+		ok, err := manifestEmpty(manifestPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			continue
+		}
+		if emptyManifest == "fail" {
+			log.Fatalf("manifest %s has no entries", manifestPath)
+		}
+		warnRegionf(selector.ManifestRegion(manifestPath), "Manifest %s has no entries", manifestPath)
+		empty[manifestPath] = true
+	}
+	return empty
+}
 
-	preexistingFilename := "analyses/" + region + ".ndjson"
-	preexisting := readPreexistingAnalyses(preexistingFilename)
-	preexistingFile, err := os.OpenFile(preexistingFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+// loadRegionTargets reads REGION_TARGETS, a JSON file mapping region names to
+// the number of pictures to select from them instead of TARGET_COUNT.
+func loadRegionTargets() {
+	targetsFile := getenv("REGION_TARGETS")
+	if targetsFile == "" {
+		return
+	}
+	data, err := os.ReadFile(targetsFile)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("invalid REGION_TARGETS ", err)
 	}
-	preexistingEnc := json.NewEncoder(preexistingFile)
-	defer preexistingFile.Close()
+	if err := json.Unmarshal(data, &regionTargets); err != nil {
+		log.Fatal("invalid REGION_TARGETS ", err)
+	}
+	for region, target := range regionTargets {
+		if target < 0 {
+			log.Fatalf("invalid REGION_TARGETS: negative target %d for %s", target, region)
+		}
+	}
+}
 
-	outFilename := "out/" + region + ".ndjson"
-	outFile, err := os.Create(outFilename)
-	if err != nil {
+// regionTarget returns the number of pictures to select from region.
+func regionTarget(region string) int {
+	if target, ok := regionTargets[region]; ok {
+		return target
+	}
+	return targetCount
+}
+
+// runCommand runs one of the subcommands that operate outside of the normal
+// processing of every region.
+func runCommand(name string, args []string) {
+	switch name {
+	case "analyze":
+		runAnalyze(args)
+	case "stats":
+		runStats(args)
+	case "migrate":
+		runMigrate(args)
+	case "review":
+		runReview(args)
+	case "recategorize":
+		runRecategorize(args)
+	case "run":
+		if len(args) > 0 {
+			onlyRegions = args
+		}
+		runRegions()
+	case "sample":
+		runSample(args)
+	case "prune":
+		runPrune(args)
+	case "flickr-auth":
+		runFlickrAuth(args)
+	case "diff":
+		runDiff(args)
+	case "serve":
+		runServe(args)
+	default:
+		log.Fatalf("unknown command %q, expected run, analyze, stats, migrate, review, recategorize, sample, prune, flickr-auth, diff or serve", name)
+	}
+}
+
+// listManifests returns the paths of every manifest to process: the files in
+// MANIFESTS_DIR and any MANIFEST_URLS.
+func listManifests() []string {
+	manifestPaths := slices.Clone(manifestURLs)
+	manifestFiles, err := os.ReadDir(manifestsDir)
+	if err != nil && !(os.IsNotExist(err) && len(manifestPaths) > 0) {
 		log.Fatal(err)
 	}
-	outEnc := json.NewEncoder(outFile)
-	defer outFile.Close()
+	for _, manifestFile := range manifestFiles {
+		manifestPaths = append(manifestPaths, filepath.Join(manifestsDir, manifestFile.Name()))
+	}
+	return manifestPaths
+}
 
+// selectManifests returns the manifests of regions, in the order listed, or
+// every manifest if regions is empty.
+func selectManifests(manifestPaths []string, regions []string) []string {
+	if len(regions) == 0 {
+		return manifestPaths
+	}
+	selected := make([]string, 0, len(regions))
+	for _, region := range regions {
+		i := slices.IndexFunc(manifestPaths, func(manifestPath string) bool {
+			return selector.ManifestRegion(manifestPath) == region
+		})
+		if i < 0 {
+			log.Fatalf("no manifest for region %s", region)
+		}
+		selected = append(selected, manifestPaths[i])
+	}
+	return selected
+}
+
+// processRegion selects up to target pictures from the manifest at
+// manifestPath. If ctx is cancelled it stops after the current picture,
+// leaving the checkpoint so a later run can resume.
+func processRegion(ctx context.Context, region string, manifestPath string, target int) RegionSummary {
+	logRegionf(region, "Processing region %s", region)
+	startTime := time.Now()
+
+	analyses := mustOpenAnalysisCache(region)
+	defer analyses.Close()
+
+	checkpointFilename := filepath.Join(analysesDir, region+".checkpoint")
+	// A dry run skips uncached entries, so it must neither resume from nor
+	// leave behind a checkpoint that a real run would pick up. Top selection
+	// only writes its output at the end, so there is nothing to resume.
+	// Incremental runs skip everything already cached, which makes rerunning
+	// one as good as resuming it.
+	checkpointing := !dryRun && selectionMode == "first" && !incremental
+	var checkpoint *Checkpoint
+	// manifestFile is where the entries are read from, a snapshot of a
+	// manifest at a URL when checkpointing so that the checkpoint's hash is
+	// of the entries processed.
+	manifestFile := manifestPath
+	var manifestHash string
+	if checkpointing {
+		manifestFile, manifestHash = snapshotManifest(manifestPath, analysesDir)
+		if manifestFile != manifestPath {
+			defer os.Remove(manifestFile)
+		}
+		checkpoint = readCheckpoint(checkpointFilename)
+	}
+	if checkpoint != nil && checkpoint.ManifestHash != manifestHash {
+		logRegionf(region, "Manifest changed since checkpoint %s, starting over", checkpointFilename)
+		checkpoint = nil
+	} else if checkpoint != nil && checkpoint.Order != manifestOrder() {
+		logRegionf(region, "SORT or SHUFFLE changed since checkpoint %s, starting over", checkpointFilename)
+		checkpoint = nil
+	}
+
+	// In review mode the selection is written as candidates for the review
+	// command to turn into the output once a curator has approved them.
+	outFilename := filepath.Join(outDir, region+outputExtension())
+	if reviewMode {
+		outFilename = candidatesFilename(region)
+	}
+	rejectedFilename := filepath.Join(outDir, region+".rejected.ndjson")
+	// Output is written to temporary files that replace the previous output
+	// once the region is done, so that a failed run leaves the last good
+	// output in place. A checkpoint continues the temporary files.
+	outTemp, rejectedTemp := tempOutputFilename(outFilename), tempOutputFilename(rejectedFilename)
+	if checkpoint != nil && (fileSize(outTemp) < checkpoint.OutSize || fileSize(rejectedTemp) < checkpoint.RejectedSize) {
+		logRegionf(region, "Output of checkpoint %s is missing, starting over", checkpointFilename)
+		checkpoint = nil
+	}
+	var outFile, rejectedFile *os.File
+	var err error
+	selectedHashes := newDedupSet(dedupDistance)
+	ownerCounts := make(map[string]int)
+	startIndex := 0
 	okCount := 0
+	appending := false
+	var previousIDs map[string]bool
+	if checkpoint != nil {
+		appending = true
+		outFile = reopenOutputFile(outTemp, checkpoint.OutSize)
+		rejectedFile = reopenOutputFile(rejectedTemp, checkpoint.RejectedSize)
+		startIndex = checkpoint.NextIndex
+		okCount = checkpoint.OKCount
+		selectedHashes.decode(checkpoint.SelectedHashes)
+		if checkpoint.OwnerCounts != nil {
+			ownerCounts = checkpoint.OwnerCounts
+		}
+		logRegionf(region, "Resuming from checkpoint at entry %d with %d found", startIndex, okCount)
+	} else if incremental && outputExists(outFilename) {
+		// Keep the earlier selection and top it up from the entries that
+		// have never been looked at.
+		ids, err := readOutputIDs(outFilename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		previousIDs = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			previousIDs[id] = true
+			if entry, ok := analyses.Get(id); ok {
+				ownerCounts[entry.Picture.Owner]++
+				if hash, err := parsePHash(entry.PHash); err == nil {
+					selectedHashes.add(id, hash)
+				}
+			}
+		}
+		okCount = len(ids)
+		appending = true
+		outFile = copyOutputFile(outFilename, outTemp)
+		rejectedFile = copyOutputFile(rejectedFilename, rejectedTemp)
+		logRegionf(region, "Continuing %s with %d found", outFilename, okCount)
+	} else {
+		outFile, err = os.Create(outTemp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rejectedFile, err = os.Create(rejectedTemp)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	defer outFile.Close()
+	var outWriter outputWriter = newCandidateOutputWriter(outFile)
+	if !reviewMode {
+		outWriter, err = newOutputWriter(outFile, appending)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	defer rejectedFile.Close()
+	rejectedEnc := json.NewEncoder(rejectedFile)
+	rejectedEnc.SetEscapeHTML(false)
+
+	index := startIndex
+	// Flickr search results change over time, so a checkpoint can only
+	// resume within the manifest. topUpStart is the index of the first search
+	// result, set by the producer of the entries once the manifest runs out.
+	var topUpStart atomic.Int64
+	topUpStart.Store(math.MaxInt64)
+	saveCheckpoint := func() {
+		if int64(index) > topUpStart.Load() {
+			return
+		}
+		writeCheckpoint(checkpointFilename, Checkpoint{
+			ManifestHash:   manifestHash,
+			Order:          manifestOrder(),
+			NextIndex:      index,
+			OKCount:        okCount,
+			OutSize:        fileOffset(outFile),
+			RejectedSize:   fileOffset(rejectedFile),
+			SelectedHashes: selectedHashes.encode(),
+			OwnerCounts:    ownerCounts,
+		})
+	}
+
+	metrics := regionMetrics{region: region}
+	metrics.selected(okCount)
 	processedCount := 0
 	apiCallCount := 0
-	for _, entry := range manifest {
-		if okCount >= targetCount {
-			break
+	cacheHits, cacheMisses := 0, 0
+	errorCount := 0
+	uncachedCount := 0
+	rejections := make(map[string]int)
+	var candidates []candidate
+	if apiCallsRemaining.Load() == 0 && !dryRun {
+		warnRegionf(region, "API call budget exhausted, processing only cached entries")
+	}
+
+	reject := func(picture selector.ManifestEntry, issues string) {
+		writeRejected(rejectedEnc, picture, issues)
+		metrics.rejected(issues)
+		for _, issue := range strings.Split(issues, ",") {
+			rejections[selector.IssueType(issue)]++
 		}
+	}
 
-		var picture ManifestEntry
-		var analysis ImageAnalysis
-		if existingEntry, ok := preexisting[entry.ID]; ok {
-			picture = existingEntry.Picture
-			analysis = existingEntry.Analysis
-		} else {
-			imageURL := flickrImagePreviewURL(entry)
-			analysis = requestImageAnalysis(imageURL)
-			picture = entry
-			if err := preexistingEnc.Encode(AnalysisEntry{Picture: picture, Analysis: analysis}); err != nil {
-				log.Fatal(err)
-			}
+	// publishedOutput describes where the output was published, in chunks
+	// with OUTPUT_CHUNK_SIZE.
+	publishedOutput := outFilename
+	// publish replaces the previous output with what has been written. If
+	// keep is set a later run will continue from the checkpoint, so the
+	// temporary files are kept for it.
+	publish := func(keep bool) {
+		publishOut := publishOutput
+		if reviewMode {
+			publishOut = publishOutputFile
+		}
+		if err := publishOut(outFilename, keep); err != nil {
+			log.Fatal(err)
+		}
+		if !reviewMode {
+			publishedOutput = outputDescription(outFilename)
+		}
+		if err := publishOutputFile(rejectedFilename, keep); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	summary := func(interrupted bool) RegionSummary {
+		r := RegionSummary{
+			Processed:    processedCount,
+			OKCount:      okCount,
+			Target:       target,
+			APICallCount: apiCallCount,
+			CacheHits:    cacheHits,
+			CacheMisses:  cacheMisses,
+			ErrorCount:   errorCount,
+			Rejections:   rejections,
+			Interrupted:  interrupted,
+		}
+		r.CacheHitRatio = cacheHitRatio(cacheHits, cacheMisses)
+		if !interrupted && okCount < target {
+			r.Shortfall = target - okCount
+		}
+		return r
+	}
+
+	// record counts the analysis as a cache hit or miss, and caches the
+	// outcome of a fresh analysis request.
+	record := func(result analysisResult) {
+		if !result.Requested {
+			cacheHits++
+			return
+		}
+		cacheMisses++
+		if !errors.Is(result.Err, errPhotoUnavailable) {
 			apiCallCount++
+			metrics.apiCall()
 		}
+		cacheAnalysisResult(analyses, result)
+	}
 
-		ok, issues := categorizeImage(analysis)
-		webPreviewURL := flickrImageWebURL(entry)
-		if ok {
-			okCount++
-			log.Printf("%d/%d OK %s %s", okCount, targetCount, webPreviewURL, entry.Title)
-			if err := outEnc.Encode(picture.ID); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			log.Printf("%d/%d NG %s %s: %s", okCount, targetCount, webPreviewURL, entry.Title, issues)
+	// cache records what has been learned about a picture since it was
+	// analyzed, superseding its earlier entry.
+	cache := func(entry AnalysisEntry) {
+		if err := analyses.Put(entry); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		processedCount++
+	// locate checks whether the picture was taken within the region, caching
+	// its location for future runs. It returns the entry with its location.
+	bounded := regionBounds[region] != nil
+	locate := func(entry AnalysisEntry) (AnalysisEntry, string, error) {
+		if !bounded {
+			return entry, "", nil
+		}
+		if !entry.Picture.IsFlickr() {
+			// Only Flickr locations can be looked up.
+			return entry, locationIssue(region, PhotoLocation{Missing: true}), nil
+		}
+		if entry.Location == nil {
+			location, err := fetchPhotoLocation(entry.Picture.ID)
+			if err != nil {
+				return entry, "", fmt.Errorf("locate: %w", err)
+			}
+			entry.Location = &location
+			cache(entry)
+		}
+		return entry, locationIssue(region, *entry.Location), nil
 	}
 
-	log.Printf("Wrote %s", outFilename)
-	log.Printf("Found %d after processing %d (%d API calls)", okCount, processedCount, apiCallCount)
-}
+	// date checks whether the picture was taken within TAKEN_AFTER and
+	// TAKEN_BEFORE, caching the date for future runs. Dry runs make no
+	// requests, so skip the check for pictures that haven't been looked up.
+	date := func(entry AnalysisEntry) (AnalysisEntry, string, error) {
+		if !checkingDates() || (entry.Date == nil && dryRun) {
+			return entry, "", nil
+		}
+		if !entry.Picture.IsFlickr() {
+			// Only Flickr dates can be looked up.
+			return entry, dateIssue(PhotoDate{Unknown: true}), nil
+		}
+		if entry.Date == nil {
+			taken, err := fetchPhotoDate(entry.Picture.ID)
+			if err != nil {
+				return entry, "", fmt.Errorf("date: %w", err)
+			}
+			entry.Date = &taken
+			cache(entry)
+		}
+		return entry, dateIssue(*entry.Date), nil
+	}
 
-func readPreexistingAnalyses(fname string) map[string]AnalysisEntry {
-	existing := make(map[string]AnalysisEntry)
-	analysesFile, err := os.Open(fname)
-	if err != nil && !os.IsNotExist(err) {
-		log.Fatal(err)
+	// readText checks whether too much of the picture is covered by text,
+	// caching the text found for future runs. Dry runs make no requests, so
+	// skip the check for pictures that haven't been looked at.
+	readText := func(entry AnalysisEntry) (AnalysisEntry, string, error) {
+		if textAreaMax == 0 || (entry.Text == nil && dryRun) {
+			return entry, "", nil
+		}
+		if entry.Text == nil {
+			if !takeAPICall() {
+				return entry, "", errors.New("detect text: API call budget exhausted")
+			}
+			text, err := requestTextDetection(ctx, region, flickrImagePreviewURL(entry.Picture))
+			apiCallCount++
+			metrics.apiCall()
+			if err != nil {
+				return entry, "", fmt.Errorf("detect text: %w", err)
+			}
+			entry.Text = &text
+			cache(entry)
+		}
+		return entry, textIssue(*entry.Text, entry.Analysis), nil
 	}
-	if err == nil {
-		defer analysesFile.Close()
-		dec := json.NewDecoder(analysesFile)
-		for {
-			var entry AnalysisEntry
-			if err := dec.Decode(&entry); err == io.EOF {
-				break
-			} else if err != nil {
-				log.Fatal(err)
+
+	// confirm checks whether the picture also passes with the analysis of
+	// the secondary provider, caching it for future runs. Dry runs make no
+	// requests, so skip the check for pictures it hasn't analyzed.
+	confirm := func(entry AnalysisEntry) (AnalysisEntry, string, error) {
+		if secondaryProvider == nil {
+			return entry, "", nil
+		}
+		analyzed := entry.Secondary != nil && entry.Secondary.Provider == secondaryProvider.Name()
+		if !analyzed && dryRun {
+			return entry, "", nil
+		}
+		if !analyzed {
+			if !takeAPICall() {
+				return entry, "", errors.New("secondary analysis: API call budget exhausted")
+			}
+			analysis, err := requestSecondaryAnalysis(ctx, flickrImagePreviewURL(entry.Picture))
+			apiCallCount++
+			metrics.apiCall()
+			if err != nil {
+				return entry, "", fmt.Errorf("secondary analysis: %w", err)
 			}
-			existing[entry.Picture.ID] = entry
+			entry.Secondary = &SecondaryAnalysis{Provider: secondaryProvider.Name(), Analysis: analysis}
+			cache(entry)
 		}
-		log.Printf("Read %d preexisting analyses from %s", len(existing), fname)
+		issues := secondaryIssues(entry)
+		if issues != "" {
+			logRegionf(region, "Providers disagree on %s: %s rejects it with %s", entry.Picture.ID, entry.Secondary.Provider, issues)
+		}
+		return entry, issues, nil
 	}
-	return existing
-}
 
-type AnalysisEntry struct {
-	Picture  ManifestEntry `json:"picture"`
-	Analysis ImageAnalysis `json:"analysis"`
-}
+	// inspect makes the checks that need further requests, which are only
+	// made for pictures that pass everything else.
+	inspect := func(entry AnalysisEntry) (AnalysisEntry, string, error) {
+		entry, issue, err := locate(entry)
+		if err != nil || issue != "" {
+			return entry, issue, err
+		}
+		entry, issue, err = date(entry)
+		if err != nil || issue != "" {
+			return entry, issue, err
+		}
+		entry, issue, err = readText(entry)
+		if err != nil || issue != "" {
+			return entry, issue, err
+		}
+		return confirm(entry)
+	}
 
-func parseManifestFile(path string) ([]ManifestEntry, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+	// duplicateOf checks whether the picture is a near duplicate of one
+	// already selected, caching its hash for future runs.
+	duplicateOf := func(entry AnalysisEntry) string {
+		if dedupDistance < 0 {
+			return ""
+		}
+		hash, err := parsePHash(entry.PHash)
+		if err != nil {
+			hash, err = fetchPreviewHash(ctx, entry.Picture)
+			if errors.Is(err, errAVIFPreview) {
+				logRegionf(region, "Not deduplicating %s: its preview is AVIF, which can't be hashed", entry.Picture.ID)
+				return ""
+			} else if err != nil {
+				warnRegionf(region, "Not deduplicating %s: %v", entry.Picture.ID, err)
+				return ""
+			}
+			entry.PHash = formatPHash(hash)
+			cache(entry)
+		}
+		if id, dist, ok := selectedHashes.match(hash); ok {
+			return fmt.Sprintf("duplicate of %s (distance %d)", id, dist)
+		}
+		selectedHashes.add(entry.Picture.ID, hash)
+		return ""
 	}
-	defer f.Close()
 
-	var entries []ManifestEntry
-	if err := json.NewDecoder(f).Decode(&entries); err != nil {
-		return nil, err
+	ownerFull := func(owner string) bool {
+		return maxPerOwner > 0 && ownerCounts[owner] >= maxPerOwner
 	}
 
-	return entries, nil
-}
+	stop := make(chan struct{})
+	// Upstream occasionally repeats an ID, which must not be analyzed or
+	// selected twice.
+	duplicates := 0
+	manifest := uniqueManifestSource(fileManifestSource(manifestFile), &duplicates)
+	// Once the manifest runs out, FLICKR_TOP_UP continues with photos found
+	// by searching the region's bounds.
+	if flickrTopUp && bounded {
+		manifestIDs := make(map[string]bool)
+		manifest = filterManifestSource(orderedManifestSource(manifest), func(entry selector.ManifestEntry) bool {
+			manifestIDs[entry.ID] = true
+			return true
+		})
+		topUp := func(yield func(selector.ManifestEntry) bool) error {
+			topUpStart.Store(int64(len(manifestIDs)))
+			logRegionf(region, "Manifest exhausted, searching Flickr for more pictures")
+			var ignored int
+			search := uniqueManifestSource(flickrSearchSource(boundingBox(regionBounds[region])), &ignored)
+			err := search(func(entry selector.ManifestEntry) bool {
+				return manifestIDs[entry.ID] || yield(entry)
+			})
+			if err != nil {
+				warnRegionf(region, "Searching Flickr: %v", err)
+			}
+			return nil
+		}
+		manifest = concatManifestSource(manifest, topUp)
+	} else {
+		manifest = orderedManifestSource(manifest)
+	}
+	remaining := skipManifestSource(manifest, startIndex)
+	if incremental {
+		remaining = filterManifestSource(remaining, func(entry selector.ManifestEntry) bool {
+			_, cached := analyses.Get(entry.ID)
+			cached = cached && !forceReanalysis(entry.ID)
+			return !cached && !previousIDs[entry.ID]
+		})
+	}
+	if maxProcessed > 0 {
+		remaining = limitManifestSource(remaining, maxProcessed)
+	}
+	if okCount >= target {
+		remaining = sliceManifestSource(nil)
+	}
+	if progressBar != nil {
+		var ignored int
+		total, err := countManifestEntries(uniqueManifestSource(fileManifestSource(manifestFile), &ignored))
+		if err != nil {
+			log.Fatal(err)
+		}
+		progressBar.start(region, startIndex, okCount, total, target)
+		defer progressBar.finish(region)
+	}
+	results := analyzeEntries(ctx, region, remaining, analyses, concurrency, !dryRun, stop)
+	// keep records a result that arrived after we stopped. Requests that were
+	// already in flight have been paid for, so their analyses are kept for
+	// next time.
+	keep := func(result analysisResult) {
+		record(result)
+		if result.Err != nil && !errors.Is(result.Err, context.Canceled) {
+			errorCount++
+			metrics.error()
+			logImage(region, "ERR", okCount, result.Picture, result.Err.Error())
+		}
+	}
+	interrupted := false
+	for result := range results {
+		// The checkpoint still points at this result, so it is looked at
+		// again on resuming, but its analysis is kept like those drained
+		// below.
+		if ctx.Err() != nil {
+			interrupted = true
+			keep(result)
+			break
+		}
+		picture := result.Picture
+		analysis := result.Analysis
+		index++
+		progressBar.update(region, index, okCount)
+		if result.Skip != "" {
+			logImage(region, "SKIP", okCount, picture, result.Skip)
+			processedCount++
+			metrics.processed()
+			if checkpointing {
+				saveCheckpoint()
+			}
+			continue
+		}
+		if result.Uncached {
+			if uncachedCount == 0 && !dryRun {
+				warnRegionf(region, "API call budget exhausted, processing only cached entries")
+			}
+			uncachedCount++
+			cacheMisses++
+			// Later runs must revisit this entry, so leave the checkpoint
+			// where it was.
+			checkpointing = false
+			continue
+		}
+		record(result)
+		if result.Err != nil {
+			errorCount++
+			metrics.error()
+			logImage(region, "ERR", okCount, picture, result.Err.Error())
+			if checkpointing {
+				saveCheckpoint()
+			}
+			continue
+		}
+		logImageAnalysis(region, picture, analysis)
+		logImageExplanation(region, picture, analysis)
+		cached := newAnalysisEntry(picture, analysis)
+		if !result.Requested {
+			cached.Provider, cached.AnalyzedURL = result.Provider, result.AnalyzedURL
+		}
+		cached.PHash, cached.Location, cached.Date, cached.Text, cached.Secondary = result.PHash, result.Location, result.Date, result.Text, result.Secondary
+		if selectionMode != "first" {
+			issues := strings.Join(selector.ContentIssues(picture, analysis, categorizeConfig), ",")
+			if issues == "" {
+				var err error
+				if cached, issues, err = inspect(cached); err != nil {
+					errorCount++
+					metrics.error()
+					logImage(region, "ERR", okCount, picture, err.Error())
+					continue
+				}
+			}
+			if issues == "" {
+				okCount++
+				score := selector.ScoreImage(analysis, categorizeConfig)
+				candidates = append(candidates, candidate{Entry: cached, Score: score})
+				logImage(region, "OK", okCount, picture, fmt.Sprintf("score %.3f", score))
+			} else {
+				logImage(region, "NG", okCount, picture, issues)
+				reject(picture, issues)
+			}
+			processedCount++
+			metrics.processed()
+			if candidatePoolFull(candidates) {
+				break
+			}
+			continue
+		}
 
-type ManifestEntry struct {
-	ID     string `json:"id"`
-	Owner  string `json:"owner"`
-	Secret string `json:"secret"`
-	Server string `json:"server"`
-	Title  string `json:"title"`
-}
+		ok, issues := selector.CategorizePicture(picture, analysis, categorizeConfig)
+		if ok {
+			var err error
+			if cached, issues, err = inspect(cached); err != nil {
+				errorCount++
+				metrics.error()
+				logImage(region, "ERR", okCount, picture, err.Error())
+				if checkpointing {
+					saveCheckpoint()
+				}
+				continue
+			}
+			ok = issues == ""
+		}
+		if ok && ownerFull(picture.Owner) {
+			logImage(region, "SKIP", okCount, picture, "owner "+picture.Owner+" reached MAX_PER_OWNER")
+			processedCount++
+			metrics.processed()
+			if checkpointing {
+				saveCheckpoint()
+			}
+			continue
+		}
+		if ok {
+			if issues = duplicateOf(cached); issues != "" {
+				ok = false
+			}
+		}
+		if ok {
+			okCount++
+			ownerCounts[picture.Owner]++
+			logImage(region, "OK", okCount, picture, "")
+			if err := outWriter.Write(picture, analysis); err != nil {
+				log.Fatal(err)
+			}
+			metrics.selected(okCount)
+			progressBar.update(region, index, okCount)
+		} else {
+			logImage(region, "NG", okCount, picture, issues)
+			reject(picture, issues)
+		}
 
-func categorizeImage(analysis ImageAnalysis) (bool, string) {
-	var issues []string
+		processedCount++
+		metrics.processed()
+		if checkpointing {
+			saveCheckpoint()
+		}
 
-	if analysis.Adult.IsAdultContent || analysis.Adult.IsRacyContent || analysis.Adult.IsGoryContent {
-		issues = append(issues, "adult/racy/gory")
+		if okCount >= target {
+			break
+		}
 	}
+	close(stop)
 
-	if analysis.Color.IsBWImg {
-		issues = append(issues, "bw")
+	for result := range results {
+		keep(result)
 	}
 
-	tags := make(map[string]float64)
-	for _, tag := range analysis.Tags {
-		tags[tag.Name] = tag.Confidence
+	if duplicates > 0 {
+		warnRegionf(region, "Dropped %d entries of %s with duplicate IDs", duplicates, manifestPath)
 	}
 
-	if tags["outdoor"] < 0.8 && tags["nature"] < 0.8 {
-		issues = append(issues, "!outdoor&&!nature")
+	if interrupted {
+		warnRegionf(region, "Interrupted after processing %d (%d API calls)", processedCount, apiCallCount)
+		if selectionMode != "first" {
+			warnRegionf(region, "Not writing a partial %s selection", selectionMode)
+		} else if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// A time-limited run keeps what it has found.
+			publish(checkpointing)
+			logRegionf(region, "Wrote %s", publishedOutput)
+		}
+		return summary(true)
 	}
-	if tags["mountain"] < 0.8 && tags["hill"] < 0.8 {
-		issues = append(issues, "!mountain&&!hill")
+
+	if selectionMode != "first" {
+		selected, rest := selectCandidates(candidates, target, func(c candidate) string {
+			if ownerFull(c.Entry.Picture.Owner) {
+				return "owner " + c.Entry.Picture.Owner + " reached MAX_PER_OWNER"
+			}
+			if issue := duplicateOf(c.Entry); issue != "" {
+				return issue
+			}
+			ownerCounts[c.Entry.Picture.Owner]++
+			return ""
+		})
+		for _, c := range selected {
+			if err := outWriter.Write(c.Entry.Picture, c.Entry.Analysis); err != nil {
+				log.Fatal(err)
+			}
+		}
+		for _, c := range rest {
+			reject(c.Entry.Picture, c.Issue)
+		}
+		okCount = len(selected)
+		metrics.selected(okCount)
 	}
-	if tags["sky"] < 0.8 && tags["landscape"] < 0.8 {
-		issues = append(issues, "!sky&&!landscape")
+
+	// Stopping at MAX_PROCESSED leaves the checkpoint for the next run to
+	// continue from.
+	limited := maxProcessed > 0 && index-startIndex >= maxProcessed && okCount < target
+	if limited {
+		logRegionf(region, "Stopped after looking at MAX_PROCESSED=%d entries", maxProcessed)
+	} else if checkpointing {
+		removeCheckpoint(checkpointFilename)
 	}
+	publish(limited && checkpointing)
 
-	imageArea := float64(analysis.Metadata.Width * analysis.Metadata.Height)
-	objectsArea := float64(0)
-	for _, obj := range analysis.Objects {
-		objectsArea += float64(obj.Rectangle.W * obj.Rectangle.H)
+	logRegionf(region, "Wrote %s", publishedOutput)
+	if reviewMode {
+		if err := writeReviewFiles(region); err != nil {
+			log.Fatal(err)
+		}
+		logRegionf(region, "Wrote %s for review, record decisions in %s", reviewSheetFilename(region), reviewDecisionsFilename(region))
 	}
-	objectPercentage := objectsArea / imageArea
-	if objectPercentage > 0.2 {
-		issues = append(issues, fmt.Sprintf("objects %.2f%%", objectPercentage*100))
+	logRegionf(region, "Found %d after processing %d (%d API calls)", okCount, processedCount, apiCallCount)
+	if cacheHits+cacheMisses > 0 {
+		logRegionf(region, "Cache: %s", formatCacheCounts(cacheHits, cacheMisses))
 	}
-
-	return len(issues) == 0, strings.Join(issues, ",")
+	if len(rejections) > 0 {
+		logRegionf(region, "Rejected: %s", formatRejections(rejections))
+	}
+	if errorCount > 0 {
+		logRegionf(region, "Skipped %d entries due to errors", errorCount)
+	}
+	if uncachedCount > 0 {
+		logRegionf(region, "Skipped %d entries with no cached analysis", uncachedCount)
+	}
+	if okCount < target {
+		warnRegionf(region, "Found %d of target %d, %d short", okCount, target, target-okCount)
+	}
+	notifyCompletion(CompletionEvent{
+		Region:          region,
+		OKCount:         okCount,
+		Target:          target,
+		Output:          outFilename,
+		DurationSeconds: time.Since(startTime).Seconds(),
+	})
+	return summary(false)
 }
 
-type ImageAnalysis struct {
-	Adult struct {
-		IsAdultContent bool `json:"isAdultContent"`
-		IsRacyContent  bool `json:"isRacyContent"`
-		IsGoryContent  bool `json:"isGoryContent"`
-	} `json:"adult"`
-	Color struct {
-		IsBWImg bool `json:"isBWImg"`
-	} `json:"color"`
-	Tags []struct {
-		Name       string  `json:"name"`
-		Confidence float64 `json:"confidence"`
-	} `json:"tags"`
-	Objects []struct {
-		Rectangle struct {
-			X int `json:"x"`
-			Y int `json:"y"`
-			W int `json:"w"`
-			H int `json:"h"`
-		} `json:"rectangle"`
-		Object     string  `json:"object"`
-		Confidence float64 `json:"confidence"`
-	} `json:"objects"`
-	Metadata struct {
-		Width  int    `json:"width"`
-		Height int    `json:"height"`
-		Format string `json:"format"`
-	} `json:"metadata"`
+// cacheAnalysisResult caches the outcome of a fresh analysis request.
+// Failures are only cached if retrying would not help.
+func cacheAnalysisResult(cache AnalysisCache, result analysisResult) {
+	entry := newAnalysisEntry(result.Picture, result.Analysis)
+	if result.Err != nil {
+		if !selector.IsPermanentError(result.Err) {
+			return
+		}
+		entry.Analysis = selector.ImageAnalysis{}
+		entry.Failure = &AnalysisFailure{
+			Reason: result.Err.Error(),
+			Time:   time.Now().UTC(),
+		}
+	}
+	if err := cache.Put(entry); err != nil {
+		log.Fatal(err)
+	}
 }
 
-type imageAnalysisRequestBody struct {
-	URL string `json:"url"`
+func writeRejected(enc *json.Encoder, picture selector.ManifestEntry, issues string) {
+	rejection := RejectedEntry{ID: picture.ID, WebURL: selector.WebURL(picture), Issues: issues}
+	if err := enc.Encode(rejection); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func requestImageAnalysis(imageURL string) ImageAnalysis {
-	reqURL, err := url.Parse(azureEndpoint)
+// fileOffset returns the current write offset of f.
+func fileOffset(f *os.File) int64 {
+	offset, err := f.Seek(0, io.SeekCurrent)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return offset
+}
 
-	reqURL.Path = "/vision/v3.1/analyze"
+// reopenOutputFile opens an output file to continue writing from a
+// checkpoint, discarding anything written after it.
+func reopenOutputFile(fname string, size int64) *os.File {
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE, 0640)
+	if err == nil {
+		err = f.Truncate(size)
+	}
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
 
-	params := map[string]string{
-		"visualFeatures": "adult,color,tags,objects",
+// copyOutputFile creates dst with the contents of src, if it exists, and
+// returns it open to add to them.
+func copyOutputFile(src, dst string) *os.File {
+	f, err := os.Create(dst)
+	if err != nil {
+		log.Fatal(err)
 	}
-	query := url.Values{}
-	for k, v := range params {
-		query.Set(k, v)
+	prev, err := openOutput(src)
+	if os.IsNotExist(err) {
+		return f
+	} else if err != nil {
+		log.Fatal(err)
 	}
-	reqURL.RawQuery = query.Encode()
+	defer prev.Close()
+	if _, err := io.Copy(f, prev); err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
 
-	body, err := json.Marshal(imageAnalysisRequestBody{URL: imageURL})
+// fileSize returns the size of fname, or -1 if it doesn't exist.
+func fileSize(fname string) int64 {
+	info, err := os.Stat(fname)
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
 
-	req := http.Request{
-		Method: "POST",
-		URL:    reqURL,
-		Header: http.Header{
-			"Content-Type":              {"application/json"},
-			"Ocp-Apim-Subscription-Key": {azureKey},
-		},
-		Body: io.NopCloser(bytes.NewReader(body)),
+// readPreexistingAnalyses reads the cached analyses in fname. Malformed lines,
+// such as one cut short when a run was killed mid-write, are skipped. An
+// unterminated final line is removed so that later appends start on a line of
+// their own, and with REPAIR_ANALYSES every malformed line is removed.
+func readPreexistingAnalyses(fname string) map[string]AnalysisEntry {
+	existing := make(map[string]AnalysisEntry)
+	analysesFile, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return existing
+	} else if err != nil {
+		log.Fatal(err)
 	}
 
-	log.Printf("Calling Azure API: %s", strings.TrimPrefix(req.URL.String(), "https://"))
+	r := bufio.NewReader(analysesFile)
+	var valid [][]byte
+	var offset int64
+	malformed := 0
+	stale := make(map[string]bool)
+	// The last line has no newline if a write was cut short, or the file was
+	// edited by hand.
+	truncateTail, terminateTail := false, false
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			log.Fatal(err)
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			var entry AnalysisEntry
+			if decodeErr := json.Unmarshal(line, &entry); decodeErr != nil {
+				malformed++
+				warnf("Skipping malformed line %d of %s: %v", lineNo, fname, decodeErr)
+				truncateTail = err == io.EOF
+			} else {
+				if entry.stale() {
+					stale[entry.Picture.ID] = true
+					delete(existing, entry.Picture.ID)
+				} else {
+					delete(stale, entry.Picture.ID)
+					existing[entry.Picture.ID] = entry
+				}
+				valid = append(valid, line)
+				terminateTail = err == io.EOF
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		offset += int64(len(line))
+	}
+	analysesFile.Close()
+	infof("Read %d preexisting analyses from %s", len(existing), fname)
+	if len(stale) > 0 {
+		infof("Ignoring %d analyses from older versions in %s, they will be analyzed again", len(stale), fname)
+	}
 
-	httpResp, err := http.DefaultClient.Do(&req)
-	if err != nil {
-		log.Fatal(err)
+	if malformed > 0 && repairAnalyses {
+		var buf bytes.Buffer
+		for _, line := range valid {
+			buf.Write(bytes.TrimRight(line, "\n"))
+			buf.WriteByte('\n')
+		}
+		if err := os.WriteFile(fname+".tmp", buf.Bytes(), 0640); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Rename(fname+".tmp", fname); err != nil {
+			log.Fatal(err)
+		}
+		infof("Removed %d malformed lines from %s", malformed, fname)
+	} else if truncateTail {
+		if err := os.Truncate(fname, offset); err != nil {
+			log.Fatal(err)
+		}
+		infof("Removed unterminated final line of %s", fname)
+	} else if terminateTail {
+		f, err := os.OpenFile(fname, os.O_APPEND|os.O_WRONLY, 0640)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString("\n"); err != nil {
+			log.Fatal(err)
+		}
 	}
-	if httpResp.StatusCode != http.StatusOK {
-		log.Fatalf("Azure API HTTP status %d", httpResp.StatusCode)
+	return existing
+}
+
+// analysisSchemaVersion is the version of the analyses written by this
+// version of the program. It is increased whenever the fields requested or how
+// they are used change in a way that makes earlier analyses unreliable.
+const analysisSchemaVersion = 1
+
+type AnalysisEntry struct {
+	// Version is the analysisSchemaVersion the entry was written with, or
+	// zero for entries from before versions were recorded.
+	Version int `json:"version"`
+	// Provider is the Name of the VisionProvider that made the analysis.
+	Provider string `json:"provider,omitempty"`
+	// AnalyzedURL is the URL of the image the provider analyzed.
+	AnalyzedURL string                 `json:"analyzedUrl,omitempty"`
+	Picture     selector.ManifestEntry `json:"picture"`
+	Analysis    selector.ImageAnalysis `json:"analysis"`
+	// PHash is the perceptual hash of the preview image, if it has been
+	// computed for deduplication.
+	PHash string `json:"phash,omitempty"`
+	// Location is where the photo was taken, if it has been looked up for
+	// REGION_BOUNDS.
+	Location *PhotoLocation `json:"location,omitempty"`
+	// Date is when the photo was taken, if it has been looked up for
+	// TAKEN_AFTER or TAKEN_BEFORE.
+	Date *PhotoDate `json:"date,omitempty"`
+	// Text is the text found in the picture, if it has been looked for with
+	// TEXT_AREA_MAX.
+	Text *selector.TextAnalysis `json:"text,omitempty"`
+	// Secondary is the analysis by the secondary provider, if the picture
+	// has been analyzed with SECONDARY_VISION_PROVIDER.
+	Secondary *SecondaryAnalysis `json:"secondary,omitempty"`
+	// Failure is set, and Analysis empty, if the picture could not be
+	// analyzed and retrying would not help.
+	Failure *AnalysisFailure `json:"failure,omitempty"`
+}
+
+// newAnalysisEntry returns the entry caching a fresh analysis by the
+// configured provider.
+func newAnalysisEntry(picture selector.ManifestEntry, analysis selector.ImageAnalysis) AnalysisEntry {
+	return AnalysisEntry{
+		Version:     analysisSchemaVersion,
+		Provider:    visionProvider.Name(),
+		AnalyzedURL: flickrImagePreviewURL(picture),
+		Picture:     picture,
+		Analysis:    analysis,
 	}
-	defer httpResp.Body.Close()
+}
 
-	var analysis ImageAnalysis
-	if err := json.NewDecoder(httpResp.Body).Decode(&analysis); err != nil {
-		log.Fatal(err)
+// stale reports whether the entry was written with an older schema version
+// and should be analyzed again. Failures don't depend on the analysis, so they
+// are never stale.
+func (e AnalysisEntry) stale() bool {
+	return e.Version < analysisSchemaVersion && e.Failure == nil && !keepStaleAnalyses
+}
+
+// secondaryIssues categorizes the picture of entry with its secondary
+// analysis, returning the issues found, each prefixed with "secondary", or
+// "" if it passes. Outside SELECTION=first only the issues that rule a
+// picture out are looked for, as with the primary analysis.
+func secondaryIssues(entry AnalysisEntry) string {
+	var issues []string
+	if selectionMode == "first" {
+		if ok, found := selector.CategorizePicture(entry.Picture, entry.Secondary.Analysis, categorizeConfig); !ok {
+			issues = strings.Split(found, ",")
+		}
+	} else {
+		issues = selector.ContentIssues(entry.Picture, entry.Secondary.Analysis, categorizeConfig)
+	}
+	for i, issue := range issues {
+		issues[i] = "secondary " + issue
 	}
+	return strings.Join(issues, ",")
+}
 
-	return analysis
+// SecondaryAnalysis is the analysis of a picture by the secondary provider.
+type SecondaryAnalysis struct {
+	// Provider is the Name of the secondary VisionProvider.
+	Provider string                 `json:"provider"`
+	Analysis selector.ImageAnalysis `json:"analysis"`
 }
 
-func flickrImagePreviewURL(photo ManifestEntry) string {
-	// https://live.staticflickr.com/{server-id}/{id}_{secret}_{size-suffix}.jpg
-	return "https://live.staticflickr.com/" + photo.Server + "/" + photo.ID + "_" + photo.Secret + "_w.jpg"
+type AnalysisFailure struct {
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
 }
 
-func flickrImageWebURL(photo ManifestEntry) string {
-	// https://www.flickr.com/photos/{owner-id}/{photo-id}
-	return "https://www.flickr.com/photos/" + photo.Owner + "/" + photo.ID
+// flickrImagePreviewURL returns the URL of the preview image that is sent for
+// analysis, with Flickr previews of FLICKR_PREVIEW_SIZE (default w) served
+// from FLICKR_IMAGE_HOST, looked up as the authorized user with FLICKR_OAUTH.
+func flickrImagePreviewURL(photo selector.ManifestEntry) string {
+	if flickrOAuth != nil {
+		return flickrAuthenticatedPreviewURL(photo)
+	}
+	return selector.PreviewURL(photo, flickrImageHost, flickrPreviewSize)
 }
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// fakeProvider is a VisionProvider that analyzes images with a function.
+type fakeProvider func(ctx context.Context, imageURL string) (selector.ImageAnalysis, error)
+
+func (f fakeProvider) Name() string { return "fake" }
+
+func (f fakeProvider) Analyze(ctx context.Context, imageURL string) (selector.ImageAnalysis, error) {
+	return f(ctx, imageURL)
+}
+
+func (f fakeProvider) Check(context.Context) error { return nil }
+
+// landscapeAnalysis returns the analysis of an outdoor picture with the given
+// mountain and sky confidences, which passes every other check.
+func landscapeAnalysis(mountain, sky float64) selector.ImageAnalysis {
+	a := selector.ImageAnalysis{
+		Adult: &selector.AdultAnalysis{},
+		Color: &selector.ColorAnalysis{},
+		Tags: []selector.AnalysisTag{
+			{Name: "outdoor", Confidence: 0.9},
+			{Name: "mountain", Confidence: mountain},
+			{Name: "sky", Confidence: sky},
+		},
+	}
+	a.Metadata.Width = 400
+	a.Metadata.Height = 300
+	return a
+}
+
+func TestRequestImageAnalysis(t *testing.T) {
+	var want selector.ImageAnalysis
+	want.Tags = []selector.AnalysisTag{{Name: "mountain", Confidence: 0.9}}
+	defer func(prev selector.VisionProvider) { visionProvider = prev }(visionProvider)
+	visionProvider = fakeProvider(func(ctx context.Context, imageURL string) (selector.ImageAnalysis, error) {
+		return want, nil
+	})
+
+	analysis, err := requestImageAnalysis(context.Background(), "alps", "https://example.com/image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(analysis, want) {
+		t.Errorf("requestImageAnalysis() = %+v, want %+v", analysis, want)
+	}
+}
+
+func TestRequestImageAnalysisTimeout(t *testing.T) {
+	defer func(prev selector.VisionProvider) { visionProvider = prev }(visionProvider)
+	visionProvider = fakeProvider(func(ctx context.Context, imageURL string) (selector.ImageAnalysis, error) {
+		<-ctx.Done()
+		return selector.ImageAnalysis{}, ctx.Err()
+	})
+	defer func(prev time.Duration) { analysisTimeout = prev }(analysisTimeout)
+	analysisTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := requestImageAnalysis(context.Background(), "alps", "https://example.com/image.jpg")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s, want ANALYSIS_TIMEOUT to cut the analysis short", elapsed)
+	}
+}
+
+func TestProcessRegionKeepsInFlightAnalysis(t *testing.T) {
+	dir := t.TempDir()
+	defer func(analyses, out, mode string, n int, backend string) {
+		analysesDir, outDir, selectionMode, concurrency, cacheBackend = analyses, out, mode, n, backend
+	}(analysesDir, outDir, selectionMode, concurrency, cacheBackend)
+	analysesDir, outDir, selectionMode, concurrency, cacheBackend = dir, dir, "first", 1, "ndjson"
+	defer func(prev int64) { apiCallsRemaining.Store(prev) }(apiCallsRemaining.Load())
+	apiCallsRemaining.Store(-1)
+
+	manifestPath := filepath.Join(dir, "alps.json")
+	manifest := `[{"id":"1","previewUrl":"https://example.com/1.jpg"}]`
+	if err := os.WriteFile(manifestPath, []byte(manifest), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The run is interrupted while the picture is being analyzed, so its
+	// analysis arrives after the run has stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer func(prev selector.VisionProvider) { visionProvider = prev }(visionProvider)
+	visionProvider = fakeProvider(func(context.Context, string) (selector.ImageAnalysis, error) {
+		cancel()
+		var analysis selector.ImageAnalysis
+		analysis.Tags = []selector.AnalysisTag{{Name: "mountain", Confidence: 0.9}}
+		return analysis, nil
+	})
+
+	summary := processRegion(ctx, "alps", manifestPath, 1)
+	if !summary.Interrupted {
+		t.Errorf("Interrupted = false, want true")
+	}
+	analyses := mustOpenAnalysisCache("alps")
+	defer analyses.Close()
+	if _, ok := analyses.Get("1"); !ok {
+		t.Errorf("analysis of 1 not cached")
+	}
+}
+
+func TestDateIssue(t *testing.T) {
+	defer func(after, before time.Time) { takenAfter, takenBefore = after, before }(takenAfter, takenBefore)
+	takenAfter = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	takenBefore = time.Time{}
+	tests := map[string]PhotoDate{
+		"":                   {Taken: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)},
+		"taken 2019-12-31":   {Taken: time.Date(2019, 12, 31, 23, 0, 0, 0, time.UTC)},
+		"date taken unknown": {Unknown: true},
+	}
+	for want, date := range tests {
+		if got := dateIssue(date); got != want {
+			t.Errorf("dateIssue(%+v) = %q, want %q", date, got, want)
+		}
+	}
+}
+
+func TestSelectRandom(t *testing.T) {
+	var candidates []candidate
+	for i, score := range []float64{0.9, 0, 0.5, 0.7} {
+		candidates = append(candidates, candidate{Entry: AnalysisEntry{Picture: selector.ManifestEntry{ID: strconv.Itoa(i)}}, Score: score})
+	}
+	noReject := func(candidate) string { return "" }
+	for seed := uint64(0); seed < 20; seed++ {
+		selected, rest := selectRandom(candidates, 3, true, rand.New(rand.NewPCG(seed, 0)), noReject)
+		if len(selected) != 3 || len(rest) != 1 || rest[0].Entry.Picture.ID != "1" {
+			t.Fatalf("seed %d: selected %v, rest %v, want the zero score left out", seed, selected, rest)
+		}
+		if rest[0].Issue != "not sampled (score 0.000)" {
+			t.Errorf("Issue = %q", rest[0].Issue)
+		}
+	}
+
+	// Candidates scoring zero are picked in an order that depends on the
+	// seed, not in manifest order.
+	var zeros []candidate
+	for i := 0; i < 5; i++ {
+		zeros = append(zeros, candidate{Entry: AnalysisEntry{Picture: selector.ManifestEntry{ID: strconv.Itoa(i)}}})
+	}
+	orders := make(map[string]bool)
+	for seed := uint64(0); seed < 20; seed++ {
+		selected, _ := selectRandom(zeros, 2, true, rand.New(rand.NewPCG(seed, 0)), noReject)
+		orders[selected[0].Entry.Picture.ID+","+selected[1].Entry.Picture.ID] = true
+	}
+	if len(orders) < 2 {
+		t.Errorf("zero score candidates picked as %v for every seed, want the order to vary", orders)
+	}
+}
+
+func TestFetchImageRetries(t *testing.T) {
+	defer func(prev time.Duration) { imageFetchRetryDelay = prev }(imageFetchRetryDelay)
+	imageFetchRetryDelay = 0
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Length", "5")
+		if requests == 1 {
+			// Cut the body short, as a dropped connection would.
+			w.Write([]byte("ab"))
+			return
+		}
+		w.Write([]byte("abcde"))
+	}))
+	defer server.Close()
+
+	data, err := fetchImage(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "abcde" || requests != 2 {
+		t.Errorf("fetchImage() = %q after %d requests, want %q after 2", data, requests, "abcde")
+	}
+
+	defer func(prev int64) { imageFetchMaxBytes = prev }(imageFetchMaxBytes)
+	imageFetchMaxBytes = 4
+	requests = 0
+	if _, err := fetchImage(context.Background(), server.URL); err == nil || requests != 1 {
+		t.Errorf("fetchImage() of an oversized image = %v after %d requests, want an error after 1", err, requests)
+	}
+}
+
+func TestFetchImageResumes(t *testing.T) {
+	defer func(prev time.Duration) { imageFetchRetryDelay = prev }(imageFetchRetryDelay)
+	imageFetchRetryDelay = 0
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("Range") == "bytes=2-" && r.Header.Get("If-Range") == `"v1"` {
+			w.Header().Set("Content-Range", "bytes 2-4/5")
+			w.Header().Set("Content-Length", "3")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("cde"))
+			return
+		}
+		// Cut the body short, as a dropped connection would.
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("ab"))
+	}))
+	defer server.Close()
+
+	data, err := fetchImage(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"", "bytes=2-"}; string(data) != "abcde" || !reflect.DeepEqual(ranges, want) {
+		t.Errorf("fetchImage() = %q with ranges %q, want %q with ranges %q", data, ranges, "abcde", want)
+	}
+}
+
+func TestFetchImageCancelledWhileWaiting(t *testing.T) {
+	defer func(prev time.Duration) { imageFetchRetryDelay = prev }(imageFetchRetryDelay)
+	imageFetchRetryDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.AfterFunc(10*time.Millisecond, cancel)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	if _, err := fetchImage(ctx, server.URL); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s, want cancelling to cut the wait short", elapsed)
+	}
+}
+
+func TestFetchPreviewHash(t *testing.T) {
+	// Gradients darkening to the right, in which every cell is brighter than
+	// its right-hand neighbour. They are decoded with the decoders dedup.go
+	// registers, which the test must not register itself.
+	images := map[string]string{
+		"gradient.png": "iVBORw0KGgoAAAANSUhEUgAAABIAAAAQCAAAAAA+bXCAAAAAFklEQVR4nGL5z/AEDTIxYIBRIZgQYAB02AhCQ0VFpAAAAABJRU5ErkJggg==",
+		"gradient.jpg": "/9j/2wCEAAMCAgMCAgMDAwMEAwMEBQgFBQQEBQoHBwYIDAoMDAsKCwsNDhIQDQ4RDgsLEBYQERMUFRUVDA8XGBYUGBIUFRQBAwQEBQQFCQUFCRQNCw0UFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFBQUFP/AAAsIABAAEgEBEQD/xADSAAABBQEBAQEBAQAAAAAAAAAAAQIDBAUGBwgJCgsQAAIBAwMCBAMFBQQEAAABfQECAwAEEQUSITFBBhNRYQcicRQygZGhCCNCscEVUtHwJDNicoIJChYXGBkaJSYnKCkqNDU2Nzg5OkNERUZHSElKU1RVVldYWVpjZGVmZ2hpanN0dXZ3eHl6g4SFhoeIiYqSk5SVlpeYmZqio6Slpqeoqaqys7S1tre4ubrCw8TFxsfIycrS09TV1tfY2drh4uPk5ebn6Onq8fLz9PX29/j5+v/aAAgBAQAAPwD7j+Pf/LX8P/adfmp8e/8Alr+H/tOvkSv3m+Pf/LX8P/adfmp8e/8Alr+H/tOvkSv/2Q==",
+	}
+	dir := t.TempDir()
+	for name, encoded := range images {
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := fetchPreviewHash(context.Background(), selector.ManifestEntry{ID: name, Path: path})
+		if err != nil {
+			t.Errorf("fetchPreviewHash(%s): %v", name, err)
+		} else if hash != math.MaxUint64 {
+			t.Errorf("fetchPreviewHash(%s) = %s, want %s", name, formatPHash(hash), formatPHash(math.MaxUint64))
+		}
+	}
+
+	path := filepath.Join(dir, "preview.avif")
+	if err := os.WriteFile(path, []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetchPreviewHash(context.Background(), selector.ManifestEntry{ID: "avif", Path: path}); !errors.Is(err, errAVIFPreview) {
+		t.Errorf("fetchPreviewHash(preview.avif) = %v, want %v", err, errAVIFPreview)
+	}
+}
+
+func TestDiffCategorizations(t *testing.T) {
+	analysis := func(id string, mountain, sky float64) AnalysisEntry {
+		return AnalysisEntry{Picture: selector.ManifestEntry{ID: id}, Analysis: landscapeAnalysis(mountain, sky)}
+	}
+	analyses := map[string]AnalysisEntry{
+		"1":  analysis("1", 0.95, 0.95),
+		"2":  analysis("2", 0.85, 0.95),
+		"3":  analysis("3", 0.95, 0.75),
+		"10": analysis("10", 0.85, 0.85),
+		"4":  {Picture: selector.ManifestEntry{ID: "4"}, Failure: &AnalysisFailure{Reason: "invalid image"}},
+	}
+	oldConfig := selector.DefaultCategorizeConfig()
+	oldConfig.Require = selector.ThresholdRules(0.8, 0.8, 0.8)
+	newConfig := selector.DefaultCategorizeConfig()
+	newConfig.Require = selector.ThresholdRules(0.8, 0.9, 0.7)
+
+	d := diffCategorizations(analyses, oldConfig, newConfig)
+	if d.OldPassed != 3 || d.NewPassed != 2 {
+		t.Errorf("passed %d then %d, want 3 then 2", d.OldPassed, d.NewPassed)
+	}
+	if want := []string{"2", "10"}; !reflect.DeepEqual(d.Rejected, want) {
+		t.Errorf("rejected %v, want %v", d.Rejected, want)
+	}
+	if want := []string{"3"}; !reflect.DeepEqual(d.Accepted, want) {
+		t.Errorf("accepted %v, want %v", d.Accepted, want)
+	}
+	if d.Issues["2"] == "" || d.Issues["3"] == "" {
+		t.Errorf("issues %v, want those of each changed picture", d.Issues)
+	}
+}
+
+func TestSplitOutput(t *testing.T) {
+	chunks, err := splitOutput([]byte("\"1\"\n\"2\"\n\"3\"\n"), false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"\"1\"\n\"2\"\n", "\"3\"\n"}; !reflect.DeepEqual(toStrings(chunks), want) {
+		t.Errorf("ndjson chunks %q, want %q", chunks, want)
+	}
+
+	chunks, err = splitOutput([]byte("id,title\n1,\"two\nlines\"\n2,x\n"), true, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"id,title\n1,\"two\nlines\"\n", "id,title\n2,x\n"}; !reflect.DeepEqual(toStrings(chunks), want) {
+		t.Errorf("CSV chunks %q, want %q", chunks, want)
+	}
+
+	chunks, err = splitOutput(nil, false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || len(chunks[0]) != 0 {
+		t.Errorf("empty output chunks %q, want one empty chunk", chunks)
+	}
+}
+
+func toStrings(chunks [][]byte) []string {
+	s := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		s[i] = string(chunk)
+	}
+	return s
+}
+
+func TestFlickrTransport(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &flickrTransport{base: http.DefaultTransport, userAgent: "test-agent"}}
+
+	defer func(host string) { flickrImageHost = host }(flickrImageHost)
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		flickrImageHost = host
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if isFlickr := host == "127.0.0.1"; (userAgent == "test-agent") != isFlickr {
+			t.Errorf("with FLICKR_IMAGE_HOST=%s sent User-Agent %q", host, userAgent)
+		}
+	}
+}
+
+func TestServeAnalyze(t *testing.T) {
+	defer func(dir string) { analysesDir = dir }(analysesDir)
+	defer func(dir string) { manifestsDir = dir }(manifestsDir)
+	analysesDir, manifestsDir = t.TempDir(), t.TempDir()
+	defer func(prev selector.VisionProvider) { visionProvider = prev }(visionProvider)
+	calls := 0
+	visionProvider = fakeProvider(func(ctx context.Context, imageURL string) (selector.ImageAnalysis, error) {
+		calls++
+		var analysis selector.ImageAnalysis
+		analysis.Metadata.Width, analysis.Metadata.Height = 400, 300
+		return analysis, nil
+	})
+	s := newSubjectServer()
+	defer s.Close()
+
+	get := func(query string) (int, analyzeReport) {
+		w := httptest.NewRecorder()
+		s.handleAnalyze(w, httptest.NewRequest("GET", "/analyze?"+query, nil))
+		var report analyzeReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		return w.Code, report
+	}
+	if code, report := get("id=1&secret=abc&server=2"); code != http.StatusOK || report.Cached || report.Picture.Secret != "abc" {
+		t.Errorf("first request: status %d, report %+v", code, report)
+	}
+	if code, report := get("id=1"); code != http.StatusOK || !report.Cached {
+		t.Errorf("second request: status %d, report %+v, want cached", code, report)
+	}
+	if calls != 1 {
+		t.Errorf("analyzed %d times, want 1", calls)
+	}
+	for _, query := range []string{"", "id=2", "id=2&secret=abc&server=2&region=../x"} {
+		if code, _ := get(query); code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHostLimitTransport(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer server.Close()
+	defer delete(hostLimits, "127.0.0.1")
+	hostLimits["127.0.0.1"] = newHostLimit(2, 0)
+	client := &http.Client{Transport: &hostLimitTransport{base: http.DefaultTransport}}
+
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if maxInFlight != 2 {
+		t.Errorf("%d requests in flight at once, want 2", maxInFlight)
+	}
+}
+
+func TestRunSummaryExitCode(t *testing.T) {
+	tests := []struct {
+		regions     []RegionSummary
+		interrupted bool
+		want        int
+	}{
+		{[]RegionSummary{{OKCount: 10, Target: 10}}, false, exitOK},
+		{[]RegionSummary{{OKCount: 10, Target: 10}, {OKCount: 5, Target: 10, Shortfall: 5}}, false, exitShortfall},
+		{[]RegionSummary{{OKCount: 5, Target: 10, Interrupted: true}, {OKCount: 5, Target: 10, Shortfall: 5}}, false, exitStopped},
+		{[]RegionSummary{{OKCount: 5, Target: 10, Interrupted: true}, {ErrorCount: 1, Shortfall: 10, Target: 10}}, false, exitErrors},
+		{[]RegionSummary{{OKCount: 5, Target: 10, Interrupted: true, ErrorCount: 1}}, true, exitInterrupted},
+	}
+	for i, test := range tests {
+		s := newRunSummary()
+		for j, r := range test.regions {
+			s.add(strconv.Itoa(j), r)
+		}
+		if got := s.exitCode(test.interrupted); got != test.want {
+			t.Errorf("test %d: exitCode() = %d, want %d", i, got, test.want)
+		}
+	}
+}
+
+func TestStreamManifestFormats(t *testing.T) {
+	want := []string{"1", "2", "3"}
+	manifests := map[string]string{
+		"alps.json":    `[{"id":"1"},{"id":"2"},{"id":"3"}]`,
+		"hills.json":   "\n  [\n{\"id\":\"1\"},\n{\"id\":\"2\"},\n{\"id\":\"3\"}\n]\n",
+		"lakes.ndjson": "{\"id\":\"1\"}\n{\"id\":\"2\"}\n\n{\"id\":\"3\"}\n",
+	}
+	dir := t.TempDir()
+	for name, content := range manifests {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		err := fileManifestSource(path)(func(entry selector.ManifestEntry) bool {
+			ids = append(ids, entry.ID)
+			return true
+		})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !reflect.DeepEqual(ids, want) {
+			t.Errorf("%s: IDs = %v, want %v", name, ids, want)
+		}
+	}
+	if region := selector.ManifestRegion(filepath.Join(dir, "lakes.ndjson")); region != "lakes" {
+		t.Errorf("ManifestRegion() = %q, want lakes", region)
+	}
+}
+
+func TestSnapshotManifest(t *testing.T) {
+	manifest := `[{"id":"1"},{"id":"2"}]`
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(manifest))
+	}))
+	defer server.Close()
+	defer func(prev []string) { manifestURLs = prev }(manifestURLs)
+	manifestURLs = []string{server.URL + "/alps.json"}
+
+	snapshot, hash := snapshotManifest(manifestURLs[0], t.TempDir())
+	data, err := os.ReadFile(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != manifest || requests != 1 {
+		t.Errorf("snapshot = %q after %d requests, want %q after 1", data, requests, manifest)
+	}
+	sum := sha256.Sum256([]byte(manifest))
+	if want := hex.EncodeToString(sum[:]); hash != want {
+		t.Errorf("hash = %s, want %s", hash, want)
+	}
+
+	// Local manifests are read where they are.
+	path := filepath.Join(t.TempDir(), "hills.json")
+	if err := os.WriteFile(path, []byte(manifest), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot, localHash := snapshotManifest(path, t.TempDir()); snapshot != path || localHash != hash {
+		t.Errorf("snapshotManifest(%s) = %s, %s, want %s, %s", path, snapshot, localHash, path, hash)
+	}
+}
+
+func TestSecondaryIssues(t *testing.T) {
+	defer func(cfg selector.CategorizeConfig) { categorizeConfig = cfg }(categorizeConfig)
+	defer func(mode string) { selectionMode = mode }(selectionMode)
+	categorizeConfig = selector.DefaultCategorizeConfig()
+	categorizeConfig.Require = selector.ThresholdRules(0.8, 0.8, 0.8)
+	selectionMode = "first"
+
+	entry := func(mountain, sky float64) AnalysisEntry {
+		return AnalysisEntry{Picture: selector.ManifestEntry{ID: "1"}, Secondary: &SecondaryAnalysis{Provider: "fake", Analysis: landscapeAnalysis(mountain, sky)}}
+	}
+	if issues := secondaryIssues(entry(0.9, 0.9)); issues != "" {
+		t.Errorf("passing analysis: issues = %q, want none", issues)
+	}
+	issues := secondaryIssues(entry(0.5, 0.5))
+	if issues == "" {
+		t.Fatal("failing analysis: no issues")
+	}
+	for _, issue := range strings.Split(issues, ",") {
+		if !strings.HasPrefix(issue, "secondary ") {
+			t.Errorf("issue %q, want it prefixed with secondary", issue)
+		}
+	}
+}
+
+func TestManifestEmpty(t *testing.T) {
+	tests := []struct {
+		name, content string
+		want          bool
+	}{
+		{"empty.json", "", true},
+		{"blank.json", "\n \n", true},
+		{"array.json", "[ ]\n", true},
+		{"one.json", `[{"id":"1"}]`, false},
+		{"lines.ndjson", "{\"id\":\"1\"}\n", false},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if empty, err := manifestEmpty(path); err != nil || empty != test.want {
+			t.Errorf("%s: manifestEmpty() = %t, %v, want %t", test.name, empty, err, test.want)
+		}
+	}
+}
+
+func TestLoadRegionProviders(t *testing.T) {
+	defer func(prev map[string]*hostLimit) { hostLimits = prev }(hostLimits)
+	hostLimits = make(map[string]*hostLimit)
+	endpointsFile := filepath.Join(t.TempDir(), "endpoints.json")
+	endpoints := `{
+		"alps": {"endpoint": "https://alps.example.com", "key": "a1,a2"},
+		"hills": {"key": "h"},
+		"fells": {"key": " f1 , f2, "}
+	}`
+	if err := os.WriteFile(endpointsFile, []byte(endpoints), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REGION_AZURE_ENDPOINTS", endpointsFile)
+	base := &selector.AzureProvider{Endpoint: "https://base.example.com", Keys: []string{"b"}, APIVersion: "3.1", MaxRetries: 2}
+
+	providers := loadRegionProviders(base)
+	alps, hills := providers["alps"].(*selector.AzureProvider), providers["hills"].(*selector.AzureProvider)
+	if alps.Endpoint != "https://alps.example.com" || !reflect.DeepEqual(alps.Keys, []string{"a1", "a2"}) || alps.MaxRetries != 2 {
+		t.Errorf("alps provider %+v, want its own endpoint and keys", alps)
+	}
+	if hills.Endpoint != base.Endpoint || !reflect.DeepEqual(hills.Keys, []string{"h"}) {
+		t.Errorf("hills provider %+v, want the base endpoint with its own key", hills)
+	}
+	if fells := providers["fells"].(*selector.AzureProvider); !reflect.DeepEqual(fells.Keys, []string{"f1", "f2"}) {
+		t.Errorf("fells keys %q, want them trimmed with the empty one dropped", fells.Keys)
+	}
+	if _, ok := hostLimits["alps.example.com"]; !ok {
+		t.Error("no limit for alps.example.com")
+	}
+}
+
+func TestLoadProxy(t *testing.T) {
+	defer func(prev http.RoundTripper) { httpClient.Transport = prev }(httpClient.Transport)
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+	t.Setenv("PROXY_URL", proxy.URL)
+
+	loadProxy()
+	resp, err := httpClient.Get("http://photos.example.com/1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if proxied != "http://photos.example.com/1.jpg" {
+		t.Errorf("proxy received %q, want the request for http://photos.example.com/1.jpg", proxied)
+	}
+}
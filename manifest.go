@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// manifestSource calls yield with each entry of a manifest in order, stopping
+// early if yield returns false.
+type manifestSource func(yield func(selector.ManifestEntry) bool) error
+
+// sliceManifestSource returns a source over manifest entries already in memory.
+func sliceManifestSource(entries []selector.ManifestEntry) manifestSource {
+	return func(yield func(selector.ManifestEntry) bool) error {
+		for _, entry := range entries {
+			if !yield(entry) {
+				break
+			}
+		}
+		return nil
+	}
+}
+
+// fileManifestSource returns a source that streams the manifest at path
+// without loading it fully into memory.
+func fileManifestSource(path string) manifestSource {
+	return func(yield func(selector.ManifestEntry) bool) error {
+		return selector.StreamManifestFile(path, yield)
+	}
+}
+
+// manifestEmpty reports whether the manifest at path has no entries, reading
+// no further than the first.
+func manifestEmpty(path string) (bool, error) {
+	empty := true
+	err := selector.StreamManifestFile(path, func(selector.ManifestEntry) bool {
+		empty = false
+		return false
+	})
+	return empty, err
+}
+
+// skipManifestSource returns a source over all but the first n entries of src.
+func skipManifestSource(src manifestSource, n int) manifestSource {
+	return func(yield func(selector.ManifestEntry) bool) error {
+		i := 0
+		return src(func(entry selector.ManifestEntry) bool {
+			i++
+			if i <= n {
+				return true
+			}
+			return yield(entry)
+		})
+	}
+}
+
+// limitManifestSource returns a source over the first n entries of src.
+func limitManifestSource(src manifestSource, n int) manifestSource {
+	return func(yield func(selector.ManifestEntry) bool) error {
+		i := 0
+		return src(func(entry selector.ManifestEntry) bool {
+			i++
+			return i <= n && yield(entry)
+		})
+	}
+}
+
+// uniqueManifestSource returns a source over the entries of src with IDs not
+// seen earlier in it, counting those dropped in duplicates.
+func uniqueManifestSource(src manifestSource, duplicates *int) manifestSource {
+	return func(yield func(selector.ManifestEntry) bool) error {
+		seen := make(map[string]bool)
+		return src(func(entry selector.ManifestEntry) bool {
+			if seen[entry.ID] {
+				*duplicates++
+				return true
+			}
+			seen[entry.ID] = true
+			return yield(entry)
+		})
+	}
+}
+
+// concatManifestSource returns a source over the entries of a followed by
+// those of b.
+func concatManifestSource(a, b manifestSource) manifestSource {
+	return func(yield func(selector.ManifestEntry) bool) error {
+		more := true
+		err := a(func(entry selector.ManifestEntry) bool {
+			more = yield(entry)
+			return more
+		})
+		if err != nil || !more {
+			return err
+		}
+		return b(yield)
+	}
+}
+
+// filterManifestSource returns a source over the entries of src for which keep
+// returns true.
+func filterManifestSource(src manifestSource, keep func(selector.ManifestEntry) bool) manifestSource {
+	return func(yield func(selector.ManifestEntry) bool) error {
+		return src(func(entry selector.ManifestEntry) bool {
+			if !keep(entry) {
+				return true
+			}
+			return yield(entry)
+		})
+	}
+}
+
+// orderedManifestSource returns a source over the entries of src in the order
+// configured by SORT and SHUFFLE. Reordering loads every entry into memory, so
+// src is returned unchanged if neither is set.
+func orderedManifestSource(src manifestSource) manifestSource {
+	if !sortManifest && shuffleSeed < 0 {
+		return src
+	}
+	return func(yield func(selector.ManifestEntry) bool) error {
+		var entries []selector.ManifestEntry
+		err := src(func(entry selector.ManifestEntry) bool {
+			entries = append(entries, entry)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		// Shuffling always starts from the sorted order so that the result
+		// only depends on the seed, not on how upstream ordered the export.
+		slices.SortStableFunc(entries, compareManifestIDs)
+		if shuffleSeed >= 0 {
+			rng := rand.New(rand.NewPCG(uint64(shuffleSeed), 0))
+			rng.Shuffle(len(entries), func(i, j int) {
+				entries[i], entries[j] = entries[j], entries[i]
+			})
+		}
+		return sliceManifestSource(entries)(yield)
+	}
+}
+
+// compareManifestIDs orders entries by ID. Flickr IDs are numeric, so shorter
+// IDs sort first.
+func compareManifestIDs(a, b selector.ManifestEntry) int {
+	if len(a.ID) != len(b.ID) {
+		return len(a.ID) - len(b.ID)
+	}
+	return strings.Compare(a.ID, b.ID)
+}
+
+// manifestOrder describes the order entries are processed in, so that a
+// checkpoint is only resumed in the order it was made in.
+func manifestOrder() string {
+	if shuffleSeed >= 0 {
+		return fmt.Sprintf("shuffle %d", shuffleSeed)
+	} else if sortManifest {
+		return "id"
+	}
+	return ""
+}
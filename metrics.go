@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// metricsRegistry holds the values exposed in the Prometheus text format when
+// METRICS_ADDR is set.
+type metricsRegistry struct {
+	mu     sync.Mutex
+	types  map[string]string
+	help   map[string]string
+	values map[string]map[string]float64 // name -> rendered labels -> value
+}
+
+var defaultMetrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	r := &metricsRegistry{
+		types:  make(map[string]string),
+		help:   make(map[string]string),
+		values: make(map[string]map[string]float64),
+	}
+	r.declare("subject_selector_images_processed_total", "counter", "Manifest entries categorized.")
+	r.declare("subject_selector_selected", "gauge", "Pictures selected so far.")
+	r.declare("subject_selector_rejections_total", "counter", "Rejected pictures by issue.")
+	r.declare("subject_selector_api_calls_total", "counter", "Vision API analysis requests.")
+	r.declare("subject_selector_errors_total", "counter", "Entries skipped due to errors.")
+	return r
+}
+
+func (r *metricsRegistry) declare(name, typ, help string) {
+	r.types[name] = typ
+	r.help[name] = help
+	r.values[name] = make(map[string]float64)
+}
+
+// add increments the named metric, with labels given as name/value pairs.
+func (r *metricsRegistry) add(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[name][renderLabels(labels)] += v
+}
+
+// set sets the named metric, with labels given as name/value pairs.
+func (r *metricsRegistry) set(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[name][renderLabels(labels)] = v
+}
+
+func renderLabels(labels []string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+	}
+	return "{" + b.String() + "}"
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	names := make([]string, 0, len(r.values))
+	for name := range r.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, r.help[name], name, r.types[name])
+		series := make([]string, 0, len(r.values[name]))
+		for labels := range r.values[name] {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+		for _, labels := range series {
+			fmt.Fprintf(w, "%s%s %g\n", name, labels, r.values[name][labels])
+		}
+	}
+}
+
+// regionMetrics records the metrics of a single region.
+type regionMetrics struct {
+	region string
+}
+
+func (m regionMetrics) processed() {
+	defaultMetrics.add("subject_selector_images_processed_total", 1, "region", m.region)
+}
+
+func (m regionMetrics) selected(okCount int) {
+	defaultMetrics.set("subject_selector_selected", float64(okCount), "region", m.region)
+}
+
+// rejected counts each of the comma-separated issues by type.
+func (m regionMetrics) rejected(issues string) {
+	for _, issue := range strings.Split(issues, ",") {
+		defaultMetrics.add("subject_selector_rejections_total", 1, "region", m.region, "issue", selector.IssueType(issue))
+	}
+}
+
+func (m regionMetrics) apiCall() {
+	defaultMetrics.add("subject_selector_api_calls_total", 1, "region", m.region)
+}
+
+func (m regionMetrics) error() {
+	defaultMetrics.add("subject_selector_errors_total", 1, "region", m.region)
+}
+
+// startMetricsServer serves metrics on addr until the returned function is
+// called.
+func startMetricsServer(addr string) (shutdown func()) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", defaultMetrics)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	infof("Serving metrics on %s/metrics", addr)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			warnf("Error shutting down metrics server: %v", err)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// outputTags are the tags whose confidences are included in verbose and CSV
+// output.
+var outputTags = []string{"outdoor", "nature", "mountain", "hill", "sky", "landscape"}
+
+// OutputEntry describes a selected picture when OUTPUT_FORMAT is "verbose".
+type OutputEntry struct {
+	ID             string             `json:"id"`
+	Title          string             `json:"title"`
+	WebURL         string             `json:"webUrl"`
+	Tags           map[string]float64 `json:"tags"`
+	ObjectFraction float64            `json:"objectFraction"`
+}
+
+func newOutputEntry(picture selector.ManifestEntry, analysis selector.ImageAnalysis) OutputEntry {
+	confidences := selector.TagConfidences(analysis)
+	tags := make(map[string]float64, len(outputTags))
+	for _, tag := range outputTags {
+		tags[tag] = confidences[tag]
+	}
+	return OutputEntry{
+		ID:             picture.ID,
+		Title:          picture.Title,
+		WebURL:         selector.WebURL(picture),
+		Tags:           tags,
+		ObjectFraction: selector.ObjectAreaFraction(analysis, categorizeConfig.ObjectConfidenceMin),
+	}
+}
+
+// RejectedEntry records a rejected picture in out/<region>.rejected.ndjson.
+type RejectedEntry struct {
+	ID     string `json:"id"`
+	WebURL string `json:"webUrl"`
+	Issues string `json:"issues"`
+}
+
+// outputWriter writes the selected pictures of a region in the configured
+// output format. Each write reaches the underlying writer before it returns.
+type outputWriter interface {
+	Write(picture selector.ManifestEntry, analysis selector.ImageAnalysis) error
+}
+
+// outputExtension is the file extension of the configured output format.
+func outputExtension() string {
+	if outputFormat == "csv" {
+		return ".csv"
+	}
+	return ".ndjson"
+}
+
+// newOutputWriter returns a writer for the configured output format. If
+// appending is set w already holds earlier output, so no header is written.
+func newOutputWriter(w io.Writer, appending bool) (outputWriter, error) {
+	switch outputFormat {
+	case "csv":
+		cw := &csvOutputWriter{w: csv.NewWriter(w)}
+		if !appending {
+			header := append([]string{"id", "owner", "title", "web_url"}, outputTags...)
+			if err := cw.writeRecord(header); err != nil {
+				return nil, err
+			}
+		}
+		return cw, nil
+	default:
+		return &jsonOutputWriter{enc: json.NewEncoder(w), verbose: outputFormat == "verbose"}, nil
+	}
+}
+
+type jsonOutputWriter struct {
+	enc     *json.Encoder
+	verbose bool
+}
+
+func (w *jsonOutputWriter) Write(picture selector.ManifestEntry, analysis selector.ImageAnalysis) error {
+	if w.verbose {
+		return w.enc.Encode(newOutputEntry(picture, analysis))
+	}
+	return w.enc.Encode(picture.ID)
+}
+
+type csvOutputWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvOutputWriter) Write(picture selector.ManifestEntry, analysis selector.ImageAnalysis) error {
+	record := []string{picture.ID, picture.Owner, picture.Title, selector.WebURL(picture)}
+	confidences := selector.TagConfidences(analysis)
+	for _, tag := range outputTags {
+		record = append(record, strconv.FormatFloat(confidences[tag], 'f', -1, 64))
+	}
+	return w.writeRecord(record)
+}
+
+func (w *csvOutputWriter) writeRecord(record []string) error {
+	if err := w.w.Write(record); err != nil {
+		return err
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// readOutputIDs returns the IDs of the pictures in an output file written in
+// any output format, or in a review candidates file.
+func readOutputIDs(fname string) ([]string, error) {
+	f, err := openOutput(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ids []string
+	if strings.HasSuffix(fname, ".csv") {
+		records, err := csv.NewReader(f).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fname, err)
+		}
+		for _, record := range records[min(1, len(records)):] {
+			ids = append(ids, record[0])
+		}
+		return ids, nil
+	}
+
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var line json.RawMessage
+		if err := dec.Decode(&line); err != nil {
+			return nil, fmt.Errorf("%s: %w", fname, err)
+		}
+		var id string
+		if json.Unmarshal(line, &id) != nil {
+			var entry struct {
+				ID      string                 `json:"id"`
+				Picture selector.ManifestEntry `json:"picture"`
+			}
+			if err := json.Unmarshal(line, &entry); err != nil {
+				return nil, fmt.Errorf("%s: %w", fname, err)
+			}
+			id = entry.ID
+			if id == "" {
+				id = entry.Picture.ID
+			}
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// tempOutputFilename is where the output destined for fname is written until
+// it is complete.
+func tempOutputFilename(fname string) string {
+	return fname + ".tmp"
+}
+
+// publishOutputFile replaces fname with its completed temporary file. If keep
+// is set the temporary file is copied instead of moved, so that writing it can
+// continue.
+func publishOutputFile(fname string, keep bool) error {
+	temp := tempOutputFilename(fname)
+	if !keep {
+		return os.Rename(temp, fname)
+	}
+	data, err := os.ReadFile(temp)
+	if err != nil {
+		return err
+	}
+	// Copy to a second temporary file so that fname is still replaced in one
+	// step.
+	if err := os.WriteFile(temp+".tmp", data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(temp+".tmp", fname)
+}
+
+// publishOutput publishes the selected pictures written to fname's temporary
+// file, split into chunks of OUTPUT_CHUNK_SIZE pictures if it is set. Chunks
+// or a whole file left by an earlier run with a different setting are
+// removed.
+func publishOutput(fname string, keep bool) error {
+	if outputChunkSize == 0 {
+		if err := publishOutputFile(fname, keep); err != nil {
+			return err
+		}
+		return removeOutputChunks(fname, 0)
+	}
+
+	temp := tempOutputFilename(fname)
+	data, err := os.ReadFile(temp)
+	if err != nil {
+		return err
+	}
+	chunks, err := splitOutput(data, strings.HasSuffix(fname, ".csv"), outputChunkSize)
+	if err != nil {
+		return fmt.Errorf("%s: %w", temp, err)
+	}
+	for i, chunk := range chunks {
+		chunkFilename := outputChunkFilename(fname, i)
+		if err := os.WriteFile(tempOutputFilename(chunkFilename), chunk, 0640); err != nil {
+			return err
+		}
+		if err := os.Rename(tempOutputFilename(chunkFilename), chunkFilename); err != nil {
+			return err
+		}
+	}
+	if err := removeOutputChunks(fname, len(chunks)); err != nil {
+		return err
+	}
+	if err := os.Remove(fname); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if !keep {
+		return os.Remove(temp)
+	}
+	return nil
+}
+
+// splitOutput splits output into chunks of size pictures each, repeating the
+// header of CSV output in every chunk. There is always at least one chunk,
+// even if it is empty.
+func splitOutput(data []byte, isCSV bool, size int) ([][]byte, error) {
+	var header []byte
+	var records [][]byte
+	if isCSV {
+		// Records can span lines when a title contains a newline, so are
+		// found by parsing.
+		r := csv.NewReader(bytes.NewReader(data))
+		r.FieldsPerRecord = -1
+		offset := int64(0)
+		for {
+			_, err := r.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			end := r.InputOffset()
+			records = append(records, data[offset:end])
+			offset = end
+		}
+		if len(records) > 0 {
+			header, records = records[0], records[1:]
+		}
+	} else {
+		for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+			if len(line) > 0 {
+				records = append(records, line)
+			}
+		}
+	}
+
+	var chunks [][]byte
+	for len(records) > 0 || len(chunks) == 0 {
+		n := min(size, len(records))
+		chunk := slices.Clone(header)
+		for _, record := range records[:n] {
+			chunk = append(chunk, record...)
+		}
+		chunks = append(chunks, chunk)
+		records = records[n:]
+	}
+	return chunks, nil
+}
+
+// outputChunkFilename returns the name of the ith chunk of fname, such as
+// out/alps.000.ndjson for out/alps.ndjson.
+func outputChunkFilename(fname string, i int) string {
+	ext := filepath.Ext(fname)
+	return fmt.Sprintf("%s.%03d%s", strings.TrimSuffix(fname, ext), i, ext)
+}
+
+// outputChunks returns the names of the chunks fname was last published in,
+// in order.
+func outputChunks(fname string) []string {
+	var chunks []string
+	for i := 0; ; i++ {
+		chunkFilename := outputChunkFilename(fname, i)
+		if _, err := os.Stat(chunkFilename); err != nil {
+			return chunks
+		}
+		chunks = append(chunks, chunkFilename)
+	}
+}
+
+// removeOutputChunks removes the chunks of fname from the nth on.
+func removeOutputChunks(fname string, n int) error {
+	chunks := outputChunks(fname)
+	for _, chunkFilename := range chunks[min(n, len(chunks)):] {
+		if err := os.Remove(chunkFilename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outputDescription describes where the output destined for fname was
+// published, for logging.
+func outputDescription(fname string) string {
+	if outputChunkSize == 0 {
+		return fname
+	}
+	return fmt.Sprintf("%s in %d chunks", outputChunkFilename(fname, 0), len(outputChunks(fname)))
+}
+
+// outputExists reports whether fname has been published, whole or in chunks.
+func outputExists(fname string) bool {
+	if _, err := os.Stat(fname); err == nil {
+		return true
+	}
+	return len(outputChunks(fname)) > 0
+}
+
+// openOutput opens the published output fname, joining its chunks back
+// together if it was split. Only the first chunk's CSV header is kept.
+func openOutput(fname string) (io.ReadCloser, error) {
+	f, err := os.Open(fname)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	chunks := outputChunks(fname)
+	if len(chunks) == 0 {
+		return nil, err
+	}
+	var joined bytes.Buffer
+	for i, chunkFilename := range chunks {
+		data, err := os.ReadFile(chunkFilename)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && strings.HasSuffix(fname, ".csv") {
+			// The header is a single line of tag names.
+			_, data, _ = bytes.Cut(data, []byte("\n"))
+		}
+		joined.Write(data)
+	}
+	return io.NopCloser(&joined), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+)
+
+// ownerAllowlist, if not nil, holds the only owners whose pictures are
+// processed. ownerDenylist holds owners whose pictures are never processed.
+var ownerAllowlist map[string]bool
+var ownerDenylist map[string]bool
+
+func loadOwnerLists() {
+	if fname := getenv("OWNER_ALLOWLIST"); fname != "" {
+		ownerAllowlist = readOwnerList(fname)
+	}
+	if fname := getenv("OWNER_DENYLIST"); fname != "" {
+		ownerDenylist = readOwnerList(fname)
+	}
+}
+
+// readOwnerList reads a file of owner IDs, one per line. Blank lines and
+// lines starting with # are ignored.
+func readOwnerList(fname string) map[string]bool {
+	f, err := os.Open(fname)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	owners := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		owners[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return owners
+}
+
+// ownerSkipReason explains why pictures by owner are skipped, or returns ""
+// if they aren't.
+func ownerSkipReason(owner string) string {
+	if ownerDenylist[owner] {
+		return "owner " + owner + " in OWNER_DENYLIST"
+	}
+	if ownerAllowlist != nil && !ownerAllowlist[owner] {
+		return "owner " + owner + " not in OWNER_ALLOWLIST"
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// errPhotoUnavailable is returned when Flickr serves its "photo unavailable"
+// placeholder instead of a picture, because it was deleted or made private.
+var errPhotoUnavailable = errors.New("flickr photo unavailable")
+
+// checkPreviewAvailable returns errPhotoUnavailable if Flickr redirects
+// requests for the picture's preview to its placeholder image. Any other
+// problem is left for the vision provider to report, as are pictures from
+// other sources.
+func checkPreviewAvailable(picture selector.ManifestEntry) error {
+	if !picture.IsFlickr() {
+		return nil
+	}
+	// Report redirects rather than following them.
+	client := *httpClient
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Head(flickrImagePreviewURL(picture))
+	if err != nil {
+		return nil
+	}
+	resp.Body.Close()
+	if isFlickrPlaceholderURL(resp.Header.Get("Location")) {
+		return errPhotoUnavailable
+	}
+	return nil
+}
+
+// isFlickrPlaceholderURL reports whether u is one of Flickr's placeholder
+// images, such as https://s.yimg.com/pw/images/en-us/photo_unavailable.png.
+func isFlickrPlaceholderURL(u string) bool {
+	return strings.Contains(u, "/photo_unavailable")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// progressBar shows how far each region has got on a status line at the
+// bottom of the terminal. It is nil unless stdout is a terminal, and all of
+// its methods do nothing on a nil receiver.
+var progressBar *progress
+
+type progress struct {
+	mu      sync.Mutex
+	regions []*regionProgress
+}
+
+type regionProgress struct {
+	region     string
+	start      time.Time
+	startIndex int
+	startOK    int
+	index      int
+	okCount    int
+	total      int
+	target     int
+}
+
+// setupProgress enables progressBar when stdout is an interactive terminal.
+// Log lines are then written above the status line rather than through it.
+func setupProgress() {
+	if jsonLogs || !isTerminal(os.Stdout) {
+		return
+	}
+	progressBar = &progress{}
+	if isTerminal(os.Stderr) {
+		log.SetOutput(progressLogWriter{progressBar})
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// start begins tracking a region that has total entries and a target of
+// target pictures, resuming at startIndex with okCount already found.
+func (p *progress) start(region string, startIndex, okCount, total, target int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.regions = append(p.regions, &regionProgress{
+		region:     region,
+		start:      time.Now(),
+		startIndex: startIndex,
+		startOK:    okCount,
+		index:      startIndex,
+		okCount:    okCount,
+		total:      total,
+		target:     target,
+	})
+	p.draw()
+}
+
+// update records that region has processed index entries and found okCount.
+func (p *progress) update(region string, index, okCount int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, r := range p.regions {
+		if r.region == region {
+			r.index = index
+			r.okCount = okCount
+		}
+	}
+	p.draw()
+}
+
+// finish stops tracking region.
+func (p *progress) finish(region string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, r := range p.regions {
+		if r.region == region {
+			p.regions = append(p.regions[:i], p.regions[i+1:]...)
+			break
+		}
+	}
+	p.clear()
+	p.draw()
+}
+
+func (p *progress) clear() {
+	fmt.Fprint(os.Stdout, "\r\033[K")
+}
+
+func (p *progress) draw() {
+	if len(p.regions) == 0 {
+		return
+	}
+	parts := make([]string, len(p.regions))
+	for i, r := range p.regions {
+		parts[i] = r.String()
+	}
+	fmt.Fprint(os.Stdout, "\r\033[K"+strings.Join(parts, " | "))
+}
+
+func (r *regionProgress) String() string {
+	eta := "?"
+	if remaining := r.remaining(); remaining >= 0 {
+		eta = remaining.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%s %d/%d entries, %d/%d found, ETA %s", r.region, r.index, r.total, r.okCount, r.target, eta)
+}
+
+// remaining estimates the time left from the average time taken per entry so
+// far, or returns -1 if nothing has been processed yet. First selection stops
+// once enough pictures are found, so it may not need the rest of the manifest.
+func (r *regionProgress) remaining() time.Duration {
+	done := r.index - r.startIndex
+	if done == 0 {
+		return -1
+	}
+	entries := r.total - r.index
+	if found := r.okCount - r.startOK; selectionMode == "first" && found > 0 {
+		entries = min(entries, (r.target-r.okCount)*done/found)
+	}
+	perEntry := time.Since(r.start) / time.Duration(done)
+	return perEntry * time.Duration(max(entries, 0))
+}
+
+// progressLogWriter writes log lines above the status line.
+type progressLogWriter struct {
+	p *progress
+}
+
+func (w progressLogWriter) Write(b []byte) (int, error) {
+	w.p.mu.Lock()
+	defer w.p.mu.Unlock()
+	w.p.clear()
+	n, err := os.Stderr.Write(b)
+	w.p.draw()
+	return n, err
+}
+
+// countManifestEntries returns the number of entries in src.
+func countManifestEntries(src manifestSource) (int, error) {
+	n := 0
+	err := src(func(selector.ManifestEntry) bool {
+		n++
+		return true
+	})
+	return n, err
+}
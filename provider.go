@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// loadVisionProvider configures the provider selected by VISION_PROVIDER.
+func loadVisionProvider() selector.VisionProvider {
+	switch name := getenv("VISION_PROVIDER"); name {
+	case "", "azure":
+		return loadAzureProvider("")
+	default:
+		log.Fatalf("invalid VISION_PROVIDER %q, expected azure", name)
+		return nil
+	}
+}
+
+// loadSecondaryProvider configures the provider selected by
+// SECONDARY_VISION_PROVIDER, if any, which is set up with the settings of the
+// primary provider prefixed with SECONDARY_, such as SECONDARY_AZURE_ENDPOINT.
+func loadSecondaryProvider() selector.VisionProvider {
+	switch name := getenv("SECONDARY_VISION_PROVIDER"); name {
+	case "":
+		return nil
+	case "azure":
+		return loadAzureProvider("SECONDARY_")
+	default:
+		log.Fatalf("invalid SECONDARY_VISION_PROVIDER %q, expected azure", name)
+		return nil
+	}
+}
+
+// regionProvider returns the provider to analyze the pictures of region with:
+// that set up by REGION_AZURE_ENDPOINTS, or else the configured provider.
+func regionProvider(region string) selector.VisionProvider {
+	if p, ok := regionProviders[region]; ok {
+		return p
+	}
+	return visionProvider
+}
+
+// requestImageAnalysis analyzes imageURL, a picture of region, with the
+// region's provider, giving up after ANALYSIS_TIMEOUT.
+func requestImageAnalysis(ctx context.Context, region, imageURL string) (selector.ImageAnalysis, error) {
+	return requestAnalysis(ctx, regionProvider(region), imageURL)
+}
+
+// requestSecondaryAnalysis is requestImageAnalysis with the secondary
+// provider.
+func requestSecondaryAnalysis(ctx context.Context, imageURL string) (selector.ImageAnalysis, error) {
+	return requestAnalysis(ctx, secondaryProvider, imageURL)
+}
+
+func requestAnalysis(ctx context.Context, provider selector.VisionProvider, imageURL string) (selector.ImageAnalysis, error) {
+	if analysisTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, analysisTimeout)
+		defer cancel()
+	}
+	return provider.Analyze(ctx, imageURL)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// reviewMode holds back the selected pictures for a curator to approve before
+// they are written as output. See the review command.
+var reviewMode bool
+
+// reviewCandidate is a picture awaiting review, as written to
+// out/<region>.candidates.ndjson.
+type reviewCandidate struct {
+	Picture  selector.ManifestEntry `json:"picture"`
+	Analysis selector.ImageAnalysis `json:"analysis"`
+}
+
+// candidateOutputWriter writes the selected pictures as review candidates.
+type candidateOutputWriter struct {
+	enc *json.Encoder
+}
+
+func newCandidateOutputWriter(w io.Writer) *candidateOutputWriter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &candidateOutputWriter{enc: enc}
+}
+
+func (w *candidateOutputWriter) Write(picture selector.ManifestEntry, analysis selector.ImageAnalysis) error {
+	return w.enc.Encode(reviewCandidate{Picture: picture, Analysis: analysis})
+}
+
+func candidatesFilename(region string) string {
+	return filepath.Join(outDir, region+".candidates.ndjson")
+}
+
+func reviewSheetFilename(region string) string {
+	return filepath.Join(outDir, region+".review.html")
+}
+
+func reviewDecisionsFilename(region string) string {
+	return filepath.Join(outDir, region+".review.txt")
+}
+
+func readReviewCandidates(fname string) ([]reviewCandidate, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var candidates []reviewCandidate
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var c reviewCandidate
+		if err := dec.Decode(&c); err != nil {
+			return nil, fmt.Errorf("%s: %w", fname, err)
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, nil
+}
+
+// readReviewDecisions reads a decisions file, in which each line is "approve"
+// or "reject" followed by a photo ID. Anything after a # is a comment. A
+// missing file has no decisions.
+func readReviewDecisions(fname string) (map[string]string, error) {
+	decisions := make(map[string]string)
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return decisions, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || (fields[0] != "approve" && fields[0] != "reject") {
+			return nil, fmt.Errorf("%s:%d: expected approve or reject followed by a photo ID", fname, n)
+		}
+		decisions[fields[1]] = fields[0]
+	}
+	return decisions, scanner.Err()
+}
+
+// writeReviewFiles writes the contact sheet of region's candidates and a
+// decisions file for the curator to edit. Every candidate is approved to
+// begin with, except that decisions already made in an earlier decisions file
+// are kept.
+func writeReviewFiles(region string) error {
+	candidates, err := readReviewCandidates(candidatesFilename(region))
+	if err != nil {
+		return err
+	}
+	decisionsFilename := reviewDecisionsFilename(region)
+	decisions, err := readReviewDecisions(decisionsFilename)
+	if err != nil {
+		return err
+	}
+
+	sheet, err := os.Create(reviewSheetFilename(region))
+	if err != nil {
+		return err
+	}
+	defer sheet.Close()
+	if err := writeContactSheet(sheet, region, candidates, filepath.Base(decisionsFilename)); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Change approve to reject to leave a picture out, then run: review %s\n", region)
+	for _, c := range candidates {
+		decision := decisions[c.Picture.ID]
+		if decision == "" {
+			decision = "approve"
+		}
+		fmt.Fprintf(&b, "%s %s # %s\n", decision, c.Picture.ID, strings.ReplaceAll(c.Picture.Title, "\n", " "))
+	}
+	return os.WriteFile(decisionsFilename, []byte(b.String()), 0640)
+}
+
+var contactSheetTemplate = template.Must(template.New("sheet").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Region}}: {{len .Pictures}} candidates</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+.sheet { display: grid; grid-template-columns: repeat(auto-fill, minmax(260px, 1fr)); gap: 1em; }
+figure { margin: 0; }
+img { width: 100%; height: 200px; object-fit: cover; background: #eee; }
+figcaption { font-size: 0.8em; overflow-wrap: anywhere; }
+</style>
+</head>
+<body>
+<h1>{{.Region}}: {{len .Pictures}} candidates</h1>
+<p>Record decisions in <code>{{.DecisionsFile}}</code>.</p>
+<div class="sheet">
+{{range .Pictures}}<figure>
+<a href="{{.WebURL}}"><img src="{{.PreviewURL}}" loading="lazy" alt=""></a>
+<figcaption><b>{{.ID}}</b> {{.Title}}</figcaption>
+</figure>
+{{end}}</div>
+</body>
+</html>
+`))
+
+type contactSheetPicture struct {
+	ID         string
+	Title      string
+	PreviewURL string
+	WebURL     string
+}
+
+// writeContactSheet writes an HTML page of thumbnails of candidates, each
+// linking to its Flickr page.
+func writeContactSheet(w io.Writer, region string, candidates []reviewCandidate, decisionsFile string) error {
+	pictures := make([]contactSheetPicture, 0, len(candidates))
+	for _, c := range candidates {
+		pictures = append(pictures, contactSheetPicture{
+			ID:         c.Picture.ID,
+			Title:      c.Picture.Title,
+			PreviewURL: flickrImagePreviewURL(c.Picture),
+			WebURL:     selector.WebURL(c.Picture),
+		})
+	}
+	return contactSheetTemplate.Execute(w, struct {
+		Region        string
+		DecisionsFile string
+		Pictures      []contactSheetPicture
+	}{region, decisionsFile, pictures})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+)
+
+// candidate is an image eligible for selection in "top" and "random"
+// selection modes.
+type candidate struct {
+	// Entry is what is cached about the candidate.
+	Entry AnalysisEntry
+	Score float64
+	// Issue explains why the candidate was not selected.
+	Issue string
+}
+
+// selectCandidates picks n candidates using the configured selection mode.
+func selectCandidates(candidates []candidate, n int, reject func(candidate) string) (selected, rest []candidate) {
+	if selectionMode == "random" {
+		return selectRandom(candidates, n, randomWeighted, newSelectionRand(), reject)
+	}
+	return selectTop(candidates, n, reject)
+}
+
+// candidatePoolFull reports whether enough candidates have been collected to
+// select from in "random" selection mode, as limited by RANDOM_POOL.
+func candidatePoolFull(candidates []candidate) bool {
+	return selectionMode == "random" && randomPool > 0 && len(candidates) >= randomPool
+}
+
+// selectTop picks the n best scoring candidates, in descending order of
+// score, skipping any for which reject returns an issue. Ties keep manifest
+// order. The candidates not selected are returned with their Issue set.
+func selectTop(candidates []candidate, n int, reject func(candidate) string) (selected, rest []candidate) {
+	sorted := append([]candidate(nil), candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Score > sorted[j].Score
+	})
+	return selectInOrder(sorted, n, reject, func(c candidate) string {
+		return fmt.Sprintf("not in top %d (score %.3f)", n, c.Score)
+	})
+}
+
+// selectRandom picks n candidates at random, skipping any for which reject
+// returns an issue. If weighted is set candidates are picked with probability
+// proportional to their score, and those scoring zero or less, in random
+// order, only once the others have run out. The candidates not selected are returned with their
+// Issue set.
+func selectRandom(candidates []candidate, n int, weighted bool, rng *rand.Rand, reject func(candidate) string) (selected, rest []candidate) {
+	shuffled := append([]candidate(nil), candidates...)
+	// Shuffling first leaves the candidates that weighting can't order, those
+	// scoring zero or less, in a random order too.
+	rng.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	if weighted {
+		// Sorting by u^(1/w) for u uniform in (0, 1] is weighted sampling
+		// without replacement (Efraimidis and Spirakis). Comparing logs
+		// avoids underflow.
+		type keyed struct {
+			c   candidate
+			key float64
+		}
+		keyedCandidates := make([]keyed, len(shuffled))
+		for i, c := range shuffled {
+			key := math.Inf(-1)
+			if c.Score > 0 {
+				key = math.Log(1-rng.Float64()) / c.Score
+			}
+			keyedCandidates[i] = keyed{c, key}
+		}
+		sort.SliceStable(keyedCandidates, func(i, j int) bool {
+			return keyedCandidates[i].key > keyedCandidates[j].key
+		})
+		for i, k := range keyedCandidates {
+			shuffled[i] = k.c
+		}
+	}
+	return selectInOrder(shuffled, n, reject, func(c candidate) string {
+		return fmt.Sprintf("not sampled (score %.3f)", c.Score)
+	})
+}
+
+// selectInOrder picks the first n of candidates for which reject returns no
+// issue, describing those left over with notSelected.
+func selectInOrder(candidates []candidate, n int, reject func(candidate) string, notSelected func(candidate) string) (selected, rest []candidate) {
+	for _, c := range candidates {
+		if len(selected) >= n {
+			c.Issue = notSelected(c)
+			rest = append(rest, c)
+		} else if issue := reject(c); issue != "" {
+			c.Issue = issue
+			rest = append(rest, c)
+		} else {
+			selected = append(selected, c)
+		}
+	}
+	return selected, rest
+}
+
+// newSelectionRand returns the source of randomness for "random" selection,
+// seeded with RANDOM_SEED if it is set.
+func newSelectionRand() *rand.Rand {
+	if randomSeed >= 0 {
+		return rand.New(rand.NewPCG(uint64(randomSeed), 0))
+	}
+	return rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+}
@@ -0,0 +1,116 @@
+package selector
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ImageAnalysis is the subset of a vision provider's response that is used
+// for categorization. Its shape follows the Azure Computer Vision v3.1 API.
+type ImageAnalysis struct {
+	// Adult is nil if the provider did not report adult content.
+	Adult *AdultAnalysis `json:"adult,omitempty"`
+	// Color is nil if the provider did not report color information.
+	Color   *ColorAnalysis   `json:"color,omitempty"`
+	Tags    []AnalysisTag    `json:"tags"`
+	Objects []AnalysisObject `json:"objects"`
+	// Categories, Description and Brands are only present if requested with
+	// AZURE_VISUAL_FEATURES.
+	Categories  []AnalysisCategory `json:"categories,omitempty"`
+	Description *ImageDescription  `json:"description,omitempty"`
+	Brands      []AnalysisBrand    `json:"brands,omitempty"`
+	Metadata    struct {
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+		Format string `json:"format"`
+	} `json:"metadata"`
+	// Raw is the provider's response as received, if it was asked to keep
+	// it, so that fields not parsed above can be used without analyzing the
+	// image again.
+	Raw json.RawMessage `json:"raw,omitempty"`
+}
+
+type AdultAnalysis struct {
+	IsAdultContent bool `json:"isAdultContent"`
+	IsRacyContent  bool `json:"isRacyContent"`
+	IsGoryContent  bool `json:"isGoryContent"`
+	// The scores between 0 and 1 behind each flag are nil in analyses cached
+	// before they were recorded.
+	AdultScore *float64 `json:"adultScore,omitempty"`
+	RacyScore  *float64 `json:"racyScore,omitempty"`
+	GoreScore  *float64 `json:"goreScore,omitempty"`
+}
+
+// flagged reports whether the image is adult, racy or gory. Each is decided
+// by comparing its score to the maximum set in cfg, or if there is none or
+// no score was recorded, by the provider's own flag.
+func (a *AdultAnalysis) flagged(cfg CategorizeConfig) bool {
+	exceeds := func(flag bool, score *float64, scoreMax float64) bool {
+		if scoreMax > 0 && score != nil {
+			return *score > scoreMax
+		}
+		return flag
+	}
+	return exceeds(a.IsAdultContent, a.AdultScore, cfg.AdultScoreMax) ||
+		exceeds(a.IsRacyContent, a.RacyScore, cfg.RacyScoreMax) ||
+		exceeds(a.IsGoryContent, a.GoreScore, cfg.GoreScoreMax)
+}
+
+type ColorAnalysis struct {
+	DominantColorForeground string   `json:"dominantColorForeground,omitempty"`
+	DominantColorBackground string   `json:"dominantColorBackground,omitempty"`
+	DominantColors          []string `json:"dominantColors,omitempty"`
+	// AccentColor is a hex color such as "1A2B3C".
+	AccentColor string `json:"accentColor,omitempty"`
+	IsBWImg     bool   `json:"isBWImg"`
+}
+
+// hasDominant reports whether want is one of the dominant colors, ignoring
+// case, since Azure capitalizes them.
+func (c ColorAnalysis) hasDominant(want string) bool {
+	for _, dominant := range c.DominantColors {
+		if strings.EqualFold(dominant, want) {
+			return true
+		}
+	}
+	return false
+}
+
+type AnalysisTag struct {
+	Name       string  `json:"name"`
+	Confidence float64 `json:"confidence"`
+}
+
+type AnalysisObject struct {
+	Rectangle  ObjectRectangle `json:"rectangle"`
+	Object     string          `json:"object"`
+	Confidence float64         `json:"confidence"`
+}
+
+type AnalysisCategory struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+type ImageDescription struct {
+	Tags     []string       `json:"tags"`
+	Captions []ImageCaption `json:"captions"`
+}
+
+type ImageCaption struct {
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence"`
+}
+
+type AnalysisBrand struct {
+	Name       string          `json:"name"`
+	Confidence float64         `json:"confidence"`
+	Rectangle  ObjectRectangle `json:"rectangle"`
+}
+
+type ObjectRectangle struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
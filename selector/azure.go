@@ -0,0 +1,529 @@
+package selector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	azureRetryBaseDelay = time.Second
+	azureRetryMaxDelay  = time.Minute
+)
+
+// AzureVisualFeatures are the features the v3.1 API can analyze, of which
+// ImageAnalysis captures adult, brands, categories, color, description, tags
+// and objects.
+var AzureVisualFeatures = []string{"adult", "brands", "categories", "color", "description", "faces", "imageType", "objects", "tags"}
+
+var DefaultAzureVisualFeatures = []string{"adult", "color", "tags", "objects"}
+
+// AzureProvider analyzes images with the Azure Computer Vision v3.1 API or
+// the Azure Image Analysis v4.0 API.
+type AzureProvider struct {
+	Endpoint string
+	// Keys are used in turn, so that several subscriptions share the load.
+	Keys []string
+	// Token, if not nil, authenticates with Azure AD bearer tokens instead
+	// of Keys.
+	Token AzureTokenSource
+	// APIVersion is either "3.1" or "4.0".
+	APIVersion string
+	// VisualFeatures are requested from the v3.1 API.
+	VisualFeatures []string
+	// MaxRetries is how many times a request that failed with a 429 or 5xx
+	// status is retried before giving up.
+	MaxRetries int
+	// Client sends the requests. If nil HTTPClient is used.
+	Client *http.Client
+	// Logf, if not nil, reports each request and retry.
+	Logf func(format string, args ...any)
+	// KeepRaw sets the Raw field of each analysis to Azure's response.
+	KeepRaw bool
+
+	keyRing     *azureKeyRing
+	keyRingOnce sync.Once
+}
+
+type imageAnalysisRequestBody struct {
+	URL string `json:"url"`
+}
+
+// imageRequestBody returns the body of a request to analyze imageURL and its
+// content type. Local images are uploaded, and anything else is passed to
+// Azure to fetch.
+func imageRequestBody(imageURL string) ([]byte, string, error) {
+	if path, ok := LocalImagePath(imageURL); ok {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, "", &PermanentError{Err: err}
+		}
+		return data, "application/octet-stream", err
+	}
+	body, err := json.Marshal(imageAnalysisRequestBody{URL: imageURL})
+	return body, "application/json", err
+}
+
+func (p *AzureProvider) Analyze(ctx context.Context, imageURL string) (ImageAnalysis, error) {
+	reqURL, err := p.analyzeURL()
+	if err != nil {
+		return ImageAnalysis{}, err
+	}
+
+	body, contentType, err := imageRequestBody(imageURL)
+	if err != nil {
+		return ImageAnalysis{}, err
+	}
+
+	respBody, err := p.post(ctx, reqURL, body, contentType)
+	if err != nil {
+		return ImageAnalysis{}, err
+	}
+
+	if p.APIVersion == "4.0" {
+		var resp imageAnalysisV4Response
+		if err := json.Unmarshal(respBody, &resp); err != nil {
+			return ImageAnalysis{}, fmt.Errorf("decode Azure API response: %w", err)
+		}
+		analysis := resp.toImageAnalysis()
+		if p.KeepRaw {
+			analysis.Raw = respBody
+		}
+		return analysis, nil
+	}
+
+	var analysis ImageAnalysis
+	if err := json.Unmarshal(respBody, &analysis); err != nil {
+		return ImageAnalysis{}, fmt.Errorf("decode Azure API response: %w", err)
+	}
+	if p.KeepRaw {
+		analysis.Raw = respBody
+	}
+	return analysis, nil
+}
+
+func (p *AzureProvider) Name() string {
+	return "azure-" + p.APIVersion
+}
+
+// Check asks Azure to analyze an empty image URL. Azure rejects that with a
+// 400 and an image error code such as InvalidImageUrl once it has accepted
+// the key, so no image is analyzed. Any other error, such as the 404 of a
+// wrong endpoint, fails the check.
+func (p *AzureProvider) Check(ctx context.Context) error {
+	reqURL, err := p.analyzeURL()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(imageAnalysisRequestBody{URL: ""})
+	if err != nil {
+		return err
+	}
+	_, err = p.post(ctx, reqURL, body, "application/json")
+	var azErr *AzureError
+	if errors.As(err, &azErr) && azErr.Status == http.StatusBadRequest && slices.Contains(azureImageErrorCodes, azErr.Code) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w (check AZURE_ENDPOINT and the credentials)", err)
+	}
+	return nil
+}
+
+// DetectText finds the lines of text in the image with the v3.1 OCR API.
+func (p *AzureProvider) DetectText(ctx context.Context, imageURL string) (TextAnalysis, error) {
+	reqURL, err := url.Parse(p.Endpoint)
+	if err != nil {
+		return TextAnalysis{}, err
+	}
+	reqURL.Path = "/vision/v3.1/ocr"
+	reqURL.RawQuery = url.Values{"detectOrientation": {"true"}}.Encode()
+
+	body, contentType, err := imageRequestBody(imageURL)
+	if err != nil {
+		return TextAnalysis{}, err
+	}
+	respBody, err := p.post(ctx, reqURL, body, contentType)
+	if err != nil {
+		return TextAnalysis{}, err
+	}
+
+	var resp ocrResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return TextAnalysis{}, fmt.Errorf("decode Azure OCR response: %w", err)
+	}
+	var text TextAnalysis
+	for _, region := range resp.Regions {
+		for _, line := range region.Lines {
+			rect, err := parseOCRBoundingBox(line.BoundingBox)
+			if err != nil {
+				return TextAnalysis{}, fmt.Errorf("decode Azure OCR response: %w", err)
+			}
+			words := make([]string, len(line.Words))
+			for i, word := range line.Words {
+				words[i] = word.Text
+			}
+			text.Lines = append(text.Lines, TextLine{Text: strings.Join(words, " "), Rectangle: rect})
+		}
+	}
+	return text, nil
+}
+
+// ocrResponse is the subset of the v3.1 OCR response that maps onto
+// TextAnalysis.
+type ocrResponse struct {
+	Regions []struct {
+		Lines []struct {
+			BoundingBox string `json:"boundingBox"`
+			Words       []struct {
+				Text string `json:"text"`
+			} `json:"words"`
+		} `json:"lines"`
+	} `json:"regions"`
+}
+
+// parseOCRBoundingBox parses an OCR bounding box of the form "x,y,w,h".
+func parseOCRBoundingBox(s string) (ObjectRectangle, error) {
+	var r ObjectRectangle
+	if _, err := fmt.Sscanf(s, "%d,%d,%d,%d", &r.X, &r.Y, &r.W, &r.H); err != nil {
+		return ObjectRectangle{}, fmt.Errorf("bounding box %q: %w", s, err)
+	}
+	return r, nil
+}
+
+// analyzeURL returns the URL of the analyze operation of the configured API
+// version.
+func (p *AzureProvider) analyzeURL() (*url.URL, error) {
+	reqURL, err := url.Parse(p.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var params map[string]string
+	if p.APIVersion == "4.0" {
+		reqURL.Path = "/computervision/imageanalysis:analyze"
+		params = map[string]string{
+			"api-version": "2023-10-01",
+			"features":    "tags,objects",
+		}
+	} else {
+		reqURL.Path = "/vision/v3.1/analyze"
+		params = map[string]string{
+			"visualFeatures": strings.Join(p.VisualFeatures, ","),
+		}
+	}
+	query := url.Values{}
+	for k, v := range params {
+		query.Set(k, v)
+	}
+	reqURL.RawQuery = query.Encode()
+	return reqURL, nil
+}
+
+// post sends body of contentType to reqURL, retrying on transient failures, and returns the
+// body of the successful response. A key that is rate limited is passed over
+// for a while in favour of the others.
+func (p *AzureProvider) post(ctx context.Context, reqURL *url.URL, body []byte, contentType string) ([]byte, error) {
+	p.keyRingOnce.Do(func() {
+		p.keyRing = newAzureKeyRing(p.Keys)
+	})
+
+	for attempt := 0; ; attempt++ {
+		key := -1
+		if p.Token == nil {
+			var wait time.Duration
+			key, wait = p.keyRing.take()
+			if err := sleepContext(ctx, wait); err != nil {
+				return nil, err
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", reqURL.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		if p.Token != nil {
+			token, err := p.Token.Token(ctx)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else {
+			req.Header.Set("Ocp-Apim-Subscription-Key", p.Keys[key])
+		}
+
+		p.logf("Calling Azure API: %s", strings.TrimPrefix(req.URL.String(), "https://"))
+
+		client := p.Client
+		if client == nil {
+			client = HTTPClient
+		}
+		httpResp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if httpResp.StatusCode == http.StatusOK {
+			defer httpResp.Body.Close()
+			return io.ReadAll(httpResp.Body)
+		}
+		errBody, _ := io.ReadAll(io.LimitReader(httpResp.Body, azureErrorBodyMax))
+		httpResp.Body.Close()
+		azErr := parseAzureError(httpResp.StatusCode, errBody)
+
+		if !azErr.retryable() || attempt >= p.MaxRetries {
+			if azErr.imageError() {
+				return nil, &PermanentError{Err: azErr}
+			}
+			return nil, azErr
+		}
+
+		delay := retryDelay(attempt, httpResp.Header.Get("Retry-After"))
+		if httpResp.StatusCode == http.StatusTooManyRequests && key >= 0 && len(p.Keys) > 1 {
+			p.keyRing.demote(key, delay)
+			p.logf("%v with key %d, passing over it for %s (attempt %d/%d)",
+				azErr, key+1, delay.Round(time.Millisecond), attempt+1, p.MaxRetries)
+			continue
+		}
+		p.logf("%v, retrying in %s (attempt %d/%d)",
+			azErr, delay.Round(time.Millisecond), attempt+1, p.MaxRetries)
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *AzureProvider) logf(format string, args ...any) {
+	if p.Logf != nil {
+		p.Logf(format, args...)
+	}
+}
+
+// sleepContext pauses for d, returning early with the context's error if it
+// is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// imageAnalysisV4Response is the subset of the Image Analysis v4.0 response
+// that maps onto ImageAnalysis.
+type imageAnalysisV4Response struct {
+	Metadata struct {
+		Width  int `json:"width"`
+		Height int `json:"height"`
+	} `json:"metadata"`
+	TagsResult *struct {
+		Values []AnalysisTag `json:"values"`
+	} `json:"tagsResult"`
+	ObjectsResult *struct {
+		Values []struct {
+			BoundingBox ObjectRectangle `json:"boundingBox"`
+			Tags        []AnalysisTag   `json:"tags"`
+		} `json:"values"`
+	} `json:"objectsResult"`
+}
+
+// toImageAnalysis converts a v4.0 response into the v3.1 shape. The v4.0 API
+// does not report adult content or color, so those are left nil for
+// Categorize to treat as unknown.
+func (r imageAnalysisV4Response) toImageAnalysis() ImageAnalysis {
+	var analysis ImageAnalysis
+	analysis.Metadata.Width = r.Metadata.Width
+	analysis.Metadata.Height = r.Metadata.Height
+	if r.TagsResult != nil {
+		analysis.Tags = r.TagsResult.Values
+	}
+	if r.ObjectsResult != nil {
+		for _, v := range r.ObjectsResult.Values {
+			obj := AnalysisObject{Rectangle: v.BoundingBox}
+			if len(v.Tags) > 0 {
+				obj.Object = v.Tags[0].Name
+				obj.Confidence = v.Tags[0].Confidence
+			}
+			analysis.Objects = append(analysis.Objects, obj)
+		}
+	}
+	return analysis
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// isImageErrorStatus reports whether status means the image itself is
+// unusable, e.g. because the photo was deleted, as opposed to a problem with
+// the request or the service.
+func isImageErrorStatus(status int) bool {
+	switch status {
+	case http.StatusBadRequest,
+		http.StatusNotFound,
+		http.StatusGone,
+		http.StatusUnsupportedMediaType:
+		return true
+	default:
+		return false
+	}
+}
+
+// azureErrorBodyMax is the most of an error response that is read.
+const azureErrorBodyMax = 64 << 10
+
+// AzureError is an unsuccessful response from Azure, with the error code and
+// message from its body if it had them.
+type AzureError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *AzureError) Error() string {
+	s := fmt.Sprintf("Azure API HTTP status %d", e.Status)
+	if e.Code != "" {
+		s += " " + e.Code
+	}
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+// azureImageErrorCodes mean that the image itself can't be analyzed, so
+// there is no point trying it again.
+var azureImageErrorCodes = []string{
+	"InvalidImageUrl",
+	"InvalidImageFormat",
+	"InvalidImageSize",
+	"InvalidImageDimension",
+	"NotSupportedImage",
+	"FailedToDownloadImage",
+}
+
+// azureTransientErrorCodes mean that the service failed and a retry may
+// succeed, whatever the status.
+var azureTransientErrorCodes = []string{
+	"InternalServerError",
+	"ServiceUnavailable",
+	"Timeout",
+	"TooManyRequests",
+}
+
+// azureRequestErrorCodes mean that the request itself is wrong, as with
+// invalid parameters or credentials or an endpoint without the API, so every
+// image would fail the same way.
+var azureRequestErrorCodes = []string{
+	"InvalidRequest",
+	"InvalidArgument",
+	"BadArgument",
+	"NotSupportedFeature",
+	"NotSupportedLanguage",
+	"Unauthorized",
+	"PermissionDenied",
+	"401",
+	"403",
+	"404",
+}
+
+// parseAzureError reads the error in the body of an unsuccessful response.
+// The APIs nest it under "error", with the most specific code in
+// "innererror", while some older responses give it at the top level.
+func parseAzureError(status int, body []byte) *AzureError {
+	type azureErrorDetail struct {
+		Code       string            `json:"code"`
+		Message    string            `json:"message"`
+		InnerError *azureErrorDetail `json:"innererror"`
+	}
+	var resp struct {
+		azureErrorDetail
+		Error *azureErrorDetail `json:"error"`
+	}
+	azErr := &AzureError{Status: status}
+	if json.Unmarshal(body, &resp) != nil {
+		return azErr
+	}
+	detail := &resp.azureErrorDetail
+	if resp.Error != nil {
+		detail = resp.Error
+	}
+	azErr.Code, azErr.Message = detail.Code, detail.Message
+	for inner := detail.InnerError; inner != nil; inner = inner.InnerError {
+		if inner.Code != "" {
+			azErr.Code = inner.Code
+		}
+		if inner.Message != "" {
+			azErr.Message = inner.Message
+		}
+	}
+	return azErr
+}
+
+// retryable reports whether the request may succeed if it is sent again.
+func (e *AzureError) retryable() bool {
+	return isRetryableStatus(e.Status) || slices.Contains(azureTransientErrorCodes, e.Code)
+}
+
+// imageError reports whether the image is unusable, as opposed to there being
+// a problem with the request or the service. Without a recognized code this
+// is decided by the status.
+func (e *AzureError) imageError() bool {
+	switch {
+	case slices.Contains(azureImageErrorCodes, e.Code):
+		return true
+	case slices.Contains(azureTransientErrorCodes, e.Code), slices.Contains(azureRequestErrorCodes, e.Code):
+		return false
+	}
+	return isImageErrorStatus(e.Status)
+}
+
+// retryDelay returns how long to wait before retrying after the given
+// (zero-indexed) attempt failed. A Retry-After header, if present, takes
+// precedence over exponential backoff with jitter.
+func retryDelay(attempt int, retryAfter string) time.Duration {
+	if retryAfter != "" {
+		if secs, err := strconv.Atoi(retryAfter); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+		if at, err := http.ParseTime(retryAfter); err == nil {
+			return max(time.Until(at), 0)
+		}
+	}
+
+	delay := azureRetryBaseDelay << attempt
+	if delay <= 0 || delay > azureRetryMaxDelay {
+		delay = azureRetryMaxDelay
+	}
+	// Jitter between half and the full delay so that concurrent workers don't
+	// retry in lockstep.
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -0,0 +1,124 @@
+package selector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// azureCognitiveServicesResource is the Azure AD resource that tokens for
+// the Computer Vision APIs are issued for.
+const azureCognitiveServicesResource = "https://cognitiveservices.azure.com"
+
+// AzureTokenSource provides Azure AD bearer tokens for authenticating to
+// Azure in place of subscription keys.
+type AzureTokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticAzureToken is a token obtained outside the program, for example with
+// "az account get-access-token".
+type StaticAzureToken string
+
+func (t StaticAzureToken) Token(context.Context) (string, error) {
+	return string(t), nil
+}
+
+// ManagedIdentityToken obtains tokens for the managed identity of the Azure
+// host the program runs on, refreshing them shortly before they expire. On
+// App Service and Container Apps the identity endpoint is given by
+// IDENTITY_ENDPOINT and IDENTITY_HEADER; elsewhere the instance metadata
+// service is used.
+type ManagedIdentityToken struct {
+	// ClientID selects a user-assigned identity. If empty the system-assigned
+	// identity is used.
+	ClientID string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// identityTransport sends the requests for managed identity tokens. The
+// identity endpoint is served by the host itself, out of reach of any proxy
+// HTTPClient is configured with, so they are never proxied.
+var identityTransport = func() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	return t
+}()
+
+func (m *ManagedIdentityToken) Token(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token != "" && time.Until(m.expires) > 5*time.Minute {
+		return m.token, nil
+	}
+
+	req, err := m.request(ctx)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Transport: identityTransport, Timeout: HTTPClient.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("managed identity token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("managed identity token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("managed identity token: HTTP status %d: %s", resp.StatusCode, body)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		// ExpiresOn is in seconds since the epoch, as a string or a number
+		// depending on the endpoint.
+		ExpiresOn json.Number `json:"expires_on"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("managed identity token: %w", err)
+	}
+	expiresOn, err := strconv.ParseInt(token.ExpiresOn.String(), 10, 64)
+	if err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("managed identity token: unexpected response %s", body)
+	}
+	m.token = token.AccessToken
+	m.expires = time.Unix(expiresOn, 0)
+	return m.token, nil
+}
+
+func (m *ManagedIdentityToken) request(ctx context.Context) (*http.Request, error) {
+	query := url.Values{"resource": {azureCognitiveServicesResource}}
+	if m.ClientID != "" {
+		query.Set("client_id", m.ClientID)
+	}
+
+	if endpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint != "" {
+		query.Set("api-version", "2019-08-01")
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+		return req, nil
+	}
+
+	query.Set("api-version", "2018-02-01")
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://169.254.169.254/metadata/identity/oauth2/token?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	return req, nil
+}
@@ -0,0 +1,48 @@
+package selector
+
+import (
+	"sync"
+	"time"
+)
+
+// azureKeyRing hands out API keys round-robin, passing over keys that were
+// recently rate limited.
+type azureKeyRing struct {
+	mu           sync.Mutex
+	keys         []string
+	next         int
+	demotedUntil []time.Time
+}
+
+func newAzureKeyRing(keys []string) *azureKeyRing {
+	return &azureKeyRing{keys: keys, demotedUntil: make([]time.Time, len(keys))}
+}
+
+// take returns the index of the key to use for the next request. If every key
+// is demoted it returns the one available soonest along with how long to wait
+// before using it.
+func (r *azureKeyRing) take() (int, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	soonest := -1
+	for range r.keys {
+		i := r.next
+		r.next = (r.next + 1) % len(r.keys)
+		if !now.Before(r.demotedUntil[i]) {
+			return i, 0
+		}
+		if soonest == -1 || r.demotedUntil[i].Before(r.demotedUntil[soonest]) {
+			soonest = i
+		}
+	}
+	return soonest, r.demotedUntil[soonest].Sub(now)
+}
+
+// demote passes over key i for d.
+func (r *azureKeyRing) demote(i int, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.demotedUntil[i] = time.Now().Add(d)
+}
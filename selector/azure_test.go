@@ -0,0 +1,377 @@
+package selector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newMockAzure serves the Azure analyze endpoints with handler, returning a
+// provider that talks to it.
+func newMockAzure(t *testing.T, apiVersion string, handler http.HandlerFunc) *AzureProvider {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &AzureProvider{
+		Endpoint:       server.URL,
+		Keys:           []string{"test-key"},
+		APIVersion:     apiVersion,
+		VisualFeatures: DefaultAzureVisualFeatures,
+		MaxRetries:     2,
+		Client:         server.Client(),
+	}
+}
+
+// serveJSON writes v as the JSON response body.
+func serveJSON(t *testing.T, w http.ResponseWriter, v any) {
+	t.Helper()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAzureProviderAnalyze(t *testing.T) {
+	want := passingAnalysis()
+	provider := newMockAzure(t, "3.1", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/vision/v3.1/analyze" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		if got := r.URL.Query().Get("visualFeatures"); got != "adult,color,tags,objects" {
+			t.Errorf("visualFeatures = %s", got)
+		}
+		if got := r.Header.Get("Ocp-Apim-Subscription-Key"); got != "test-key" {
+			t.Errorf("key = %s", got)
+		}
+		var body imageAnalysisRequestBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		if body.URL != "https://example.com/image.jpg" {
+			t.Errorf("url = %s", body.URL)
+		}
+		serveJSON(t, w, want)
+	})
+
+	got, err := provider.Analyze(context.Background(), "https://example.com/image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Analyze() = %+v, want %+v", got, want)
+	}
+}
+
+func TestAzureProviderKeepRaw(t *testing.T) {
+	provider := newMockAzure(t, "3.1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"tags":[{"name":"mountain","confidence":0.9}],"requestId":"abc"}`)
+	})
+	provider.KeepRaw = true
+
+	got, err := provider.Analyze(context.Background(), "https://example.com/image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw struct {
+		RequestID string `json:"requestId"`
+	}
+	if err := json.Unmarshal(got.Raw, &raw); err != nil || raw.RequestID != "abc" {
+		t.Errorf("Raw = %s, want the response", got.Raw)
+	}
+	if len(got.Tags) != 1 {
+		t.Errorf("Tags = %+v, want those of the response", got.Tags)
+	}
+}
+
+func TestAzureProviderToken(t *testing.T) {
+	provider := newMockAzure(t, "3.1", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+			t.Errorf("Authorization = %s", got)
+		}
+		if got := r.Header.Get("Ocp-Apim-Subscription-Key"); got != "" {
+			t.Errorf("key = %s", got)
+		}
+		serveJSON(t, w, passingAnalysis())
+	})
+	provider.Keys = nil
+	provider.Token = StaticAzureToken("test-token")
+
+	if _, err := provider.Analyze(context.Background(), "https://example.com/image.jpg"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManagedIdentityTokenBypassesProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("proxy received %s", r.URL)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	defer func(prev http.RoundTripper) { HTTPClient.Transport = prev }(HTTPClient.Transport)
+	HTTPClient.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+
+	identity := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveJSON(t, w, map[string]any{"access_token": "token", "expires_on": time.Now().Add(time.Hour).Unix()})
+	}))
+	defer identity.Close()
+	t.Setenv("IDENTITY_ENDPOINT", identity.URL)
+
+	token, err := (&ManagedIdentityToken{}).Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "token" {
+		t.Errorf("Token() = %q, want %q", token, "token")
+	}
+}
+
+func TestAzureProviderUploadsLocalImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.jpg")
+	if err := os.WriteFile(path, []byte("jpeg data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider := newMockAzure(t, "3.1", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Content-Type"); got != "application/octet-stream" {
+			t.Errorf("Content-Type = %s", got)
+		}
+		if body, _ := io.ReadAll(r.Body); string(body) != "jpeg data" {
+			t.Errorf("body = %q", body)
+		}
+		serveJSON(t, w, passingAnalysis())
+	})
+
+	if _, err := provider.Analyze(context.Background(), LocalImageURL(path)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := provider.Analyze(context.Background(), LocalImageURL(path+".missing"))
+	if !IsPermanentError(err) {
+		t.Errorf("err = %v, want a permanent error", err)
+	}
+}
+
+func TestAzureProviderAnalyzeV4(t *testing.T) {
+	provider := newMockAzure(t, "4.0", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/computervision/imageanalysis:analyze" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"metadata": {"width": 400, "height": 300},
+			"tagsResult": {"values": [{"name": "mountain", "confidence": 0.9}]},
+			"objectsResult": {"values": [{
+				"boundingBox": {"x": 1, "y": 2, "w": 30, "h": 40},
+				"tags": [{"name": "person", "confidence": 0.7}]
+			}]}
+		}`))
+	})
+
+	got, err := provider.Analyze(context.Background(), "https://example.com/image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want ImageAnalysis
+	want.Metadata.Width = 400
+	want.Metadata.Height = 300
+	want.Tags = []AnalysisTag{{Name: "mountain", Confidence: 0.9}}
+	want.Objects = []AnalysisObject{{
+		Rectangle:  ObjectRectangle{X: 1, Y: 2, W: 30, H: 40},
+		Object:     "person",
+		Confidence: 0.7,
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Analyze() = %+v, want %+v", got, want)
+	}
+}
+
+func TestAzureProviderRetries(t *testing.T) {
+	calls := 0
+	provider := newMockAzure(t, "3.1", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		serveJSON(t, w, passingAnalysis())
+	})
+
+	if _, err := provider.Analyze(context.Background(), "https://example.com/image.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+}
+
+func TestAzureProviderGivesUp(t *testing.T) {
+	calls := 0
+	provider := newMockAzure(t, "3.1", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	_, err := provider.Analyze(context.Background(), "https://example.com/image.jpg")
+	if err == nil || IsPermanentError(err) {
+		t.Fatalf("err = %v, want a transient error", err)
+	}
+	if calls != provider.MaxRetries+1 {
+		t.Errorf("calls = %d, want %d", calls, provider.MaxRetries+1)
+	}
+}
+
+func TestAzureProviderPermanentError(t *testing.T) {
+	provider := newMockAzure(t, "3.1", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"code":"InvalidImageUrl","message":"Image URL is badly formatted."}}`))
+	})
+
+	_, err := provider.Analyze(context.Background(), "https://example.com/image.jpg")
+	if !IsPermanentError(err) {
+		t.Errorf("err = %v, want a permanent error", err)
+	}
+}
+
+func TestAzureProviderErrorCodes(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		calls     int
+		permanent bool
+	}{
+		{"image size", http.StatusBadRequest, `{"error":{"code":"InvalidImageSize","message":"Image is too large."}}`, 1, true},
+		{"inner image code", http.StatusBadRequest, `{"error":{"code":"InvalidRequest","message":"Bad request.","innererror":{"code":"InvalidImageUrl","message":"Image URL is badly formatted."}}}`, 1, true},
+		{"bad argument", http.StatusBadRequest, `{"error":{"code":"InvalidRequest","innererror":{"code":"BadArgument","message":"Invalid visual feature."}}}`, 1, false},
+		{"top level", http.StatusBadRequest, `{"code":"InvalidImageFormat","message":"Input data is not a valid image."}`, 1, true},
+		{"wrong endpoint", http.StatusNotFound, `{"error":{"code":"404","message":"Resource not found"}}`, 1, false},
+		{"transient code", http.StatusBadRequest, `{"error":{"code":"InternalServerError","message":"Try again."}}`, 3, false},
+		{"no body", http.StatusBadRequest, ``, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			provider := newMockAzure(t, "3.1", func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			_, err := provider.Analyze(context.Background(), "https://example.com/image.jpg")
+			if err == nil {
+				t.Fatal("Analyze() succeeded, want an error")
+			}
+			if IsPermanentError(err) != tt.permanent {
+				t.Errorf("err = %v, permanent = %t, want %t", err, IsPermanentError(err), tt.permanent)
+			}
+			var azErr *AzureError
+			if !errors.As(err, &azErr) {
+				t.Fatalf("err = %v, want an *AzureError", err)
+			}
+			if want := parseAzureError(tt.status, []byte(tt.body)).Code; want != "" && !strings.Contains(err.Error(), want) {
+				t.Errorf("err = %v, want it to contain %s", err, want)
+			}
+			if calls != tt.calls {
+				t.Errorf("calls = %d, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestAzureProviderCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		ok     bool
+	}{
+		{"empty URL rejected", http.StatusBadRequest, `{"error":{"code":"InvalidImageUrl","message":"Image URL is badly formatted."}}`, true},
+		{"v4 empty URL rejected", http.StatusBadRequest, `{"error":{"code":"InvalidRequest","innererror":{"code":"InvalidImageUrl","message":"Image URL is badly formatted."}}}`, true},
+		{"bad argument", http.StatusBadRequest, `{"error":{"code":"InvalidRequest","innererror":{"code":"BadArgument","message":"Invalid visual feature."}}}`, false},
+		{"wrong key", http.StatusUnauthorized, `{"error":{"code":"401","message":"Access denied due to invalid subscription key."}}`, false},
+		{"wrong endpoint", http.StatusNotFound, `{"error":{"code":"404","message":"Resource not found"}}`, false},
+		{"no body", http.StatusBadRequest, ``, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newMockAzure(t, "3.1", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			err := provider.Check(context.Background())
+			if (err == nil) != tt.ok {
+				t.Errorf("Check() = %v, want ok = %t", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAzureProviderUsesHTTPClientTimeout(t *testing.T) {
+	provider := newMockAzure(t, "3.1", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		serveJSON(t, w, passingAnalysis())
+	})
+	defer func(prev *http.Client) { HTTPClient = prev }(HTTPClient)
+	HTTPClient = &http.Client{Timeout: 20 * time.Millisecond}
+	provider.Client = nil
+
+	if _, err := provider.Analyze(context.Background(), "https://example.com/image.jpg"); err == nil {
+		t.Error("Analyze() succeeded, want a timeout")
+	}
+}
+
+func TestAzureProviderContextTimeout(t *testing.T) {
+	provider := newMockAzure(t, "3.1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := provider.Analyze(ctx, "https://example.com/image.jpg")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s, want the retry delay to be cut short", elapsed)
+	}
+}
+
+func TestAzureProviderDetectText(t *testing.T) {
+	provider := newMockAzure(t, "3.1", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/vision/v3.1/ocr" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"regions": [{"boundingBox": "10,20,100,30", "lines": [
+			{"boundingBox": "10,20,100,12", "words": [{"text": "Mont"}, {"text": "Blanc"}]},
+			{"boundingBox": "10,38,60,12", "words": [{"text": "4808m"}]}
+		]}]}`))
+	})
+
+	got, err := provider.DetectText(context.Background(), "https://example.com/image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TextAnalysis{Lines: []TextLine{
+		{Text: "Mont Blanc", Rectangle: ObjectRectangle{X: 10, Y: 20, W: 100, H: 12}},
+		{Text: "4808m", Rectangle: ObjectRectangle{X: 10, Y: 38, W: 60, H: 12}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DetectText() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,368 @@
+// Package selector decides whether pictures make good ContourGuessr subjects.
+// It analyzes images with a VisionProvider such as AzureProvider and
+// categorizes the analyses against a CategorizeConfig, and reads the
+// manifests of pictures the command works through.
+package selector
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Categorize decides whether an image is a suitable subject given its
+// analysis, and if not, describes the issues with it, separated by commas.
+func Categorize(analysis ImageAnalysis, cfg CategorizeConfig) (bool, string) {
+	return categorize(imageIssues(analysis, cfg), analysis, cfg)
+}
+
+// CategorizePicture is Categorize for a picture from a manifest, which also
+// rejects Flickr's placeholder for a missing photo.
+func CategorizePicture(picture ManifestEntry, analysis ImageAnalysis, cfg CategorizeConfig) (bool, string) {
+	return categorize(ContentIssues(picture, analysis, cfg), analysis, cfg)
+}
+
+// categorize adds the issues with the tags and objects in analysis to those
+// already found with its content.
+func categorize(issues []string, analysis ImageAnalysis, cfg CategorizeConfig) (bool, string) {
+	tags := TagConfidences(analysis)
+
+	if len(analysis.Tags) < cfg.MinTags {
+		issues = append(issues, fmt.Sprintf("insufficient-analysis (%d tags)", len(analysis.Tags)))
+	} else {
+		for _, rule := range cfg.Require {
+			if ok, issue := rule.eval(tags); !ok {
+				issues = append(issues, issue)
+			}
+		}
+	}
+
+	classFractions := objectClassAreaFractions(analysis, cfg.ObjectConfidenceMin)
+	classes := make([]string, 0, len(classFractions))
+	for class := range classFractions {
+		classes = append(classes, class)
+	}
+	slices.Sort(classes)
+	for _, class := range classes {
+		fraction := classFractions[class]
+		if slices.Contains(cfg.IgnoreObjectClasses, class) {
+			continue
+		}
+		if classMax, ok := cfg.ObjectClassAreaMax[class]; ok && fraction > classMax {
+			issues = append(issues, fmt.Sprintf("objects[%s] %.2f%%", class, fraction*100))
+		}
+	}
+	objectFraction, largestClass := generalObjectFraction(classFractions, cfg)
+	if objectFraction > cfg.ObjectAreaMax {
+		issue := fmt.Sprintf("objects %.2f%% (mostly %s)", objectFraction*100, largestClass)
+		if raw, _ := generalObjectFraction(objectClassAreaFractions(analysis, 0), cfg); raw != objectFraction {
+			issue = fmt.Sprintf("objects %.2f%% (mostly %s, %.2f%% unfiltered)", objectFraction*100, largestClass, raw*100)
+		}
+		issues = append(issues, issue)
+	}
+
+	return len(issues) == 0, strings.Join(issues, ",")
+}
+
+// IssueType strips the measured values from an issue, leaving a label
+// suitable for counting issues of the same kind together. For example
+// "objects 25.00% (mostly car)" becomes "objects".
+func IssueType(issue string) string {
+	var words []string
+	for _, word := range strings.Fields(issue) {
+		if strings.ContainsAny(word, "0123456789(") {
+			break
+		}
+		words = append(words, word)
+	}
+	if len(words) > 1 && words[len(words)-1] == "of" {
+		words = words[:len(words)-1]
+	}
+	return strings.Join(words, " ")
+}
+
+// ContentIssues returns the issues that rule a picture out no matter how
+// well it scores: being Flickr's placeholder for a missing photo, and those
+// found by imageIssues.
+func ContentIssues(picture ManifestEntry, analysis ImageAnalysis, cfg CategorizeConfig) []string {
+	if picture.IsFlickr() && isFlickrPlaceholder(analysis) {
+		return []string{"flickr placeholder"}
+	}
+	return imageIssues(analysis, cfg)
+}
+
+// imageIssues returns the issues that rule an image out no matter how well
+// it scores: adult content, being black and white, the wrong colors, a
+// disqualifying tag, too low a resolution, the wrong shape, prominent brands,
+// an off-center subject and too low a score.
+func imageIssues(analysis ImageAnalysis, cfg CategorizeConfig) []string {
+	var issues []string
+
+	if cfg.RejectAdult {
+		if analysis.Adult == nil {
+			if !cfg.AllowMissingAdult {
+				issues = append(issues, "adult/racy/gory unknown")
+			}
+		} else if analysis.Adult.flagged(cfg) {
+			issues = append(issues, "adult/racy/gory")
+		}
+	}
+
+	if cfg.RejectBW {
+		if analysis.Color == nil {
+			if !cfg.AllowMissingColor {
+				issues = append(issues, "bw unknown")
+			}
+		} else if analysis.Color.IsBWImg {
+			issues = append(issues, "bw")
+		}
+	}
+
+	if len(cfg.RequireDominantColors) > 0 || len(cfg.RejectDominantColors) > 0 {
+		if analysis.Color == nil {
+			if !cfg.AllowMissingColor {
+				issues = append(issues, "dominant colors unknown")
+			}
+		} else {
+			issues = append(issues, dominantColorIssues(*analysis.Color, cfg)...)
+		}
+	}
+
+	issues = append(issues, rejectTagIssues(analysis, cfg)...)
+	if issue := resolutionIssue(analysis, cfg); issue != "" {
+		issues = append(issues, issue)
+	}
+	if issue := aspectIssue(analysis, cfg); issue != "" {
+		issues = append(issues, issue)
+	}
+	if cfg.Score != nil {
+		if score := cfg.Score.Eval(TagConfidences(analysis)); score < cfg.ScoreMin {
+			issues = append(issues, fmt.Sprintf("score %.3f", score))
+		}
+	}
+	if cfg.BrandConfidenceMax > 0 {
+		for _, brand := range analysis.Brands {
+			if brand.Confidence > cfg.BrandConfidenceMax {
+				issues = append(issues, fmt.Sprintf("brand (%s %.2f)", brand.Name, brand.Confidence))
+			}
+		}
+	}
+	if issue := subjectIssue(analysis, cfg); issue != "" {
+		issues = append(issues, issue)
+	}
+
+	return issues
+}
+
+// rejectTagIssues reports each of the RejectTags the image has at or above its
+// confidence, in alphabetical order.
+func rejectTagIssues(analysis ImageAnalysis, cfg CategorizeConfig) []string {
+	if len(cfg.RejectTags) == 0 {
+		return nil
+	}
+	tags := make([]string, 0, len(cfg.RejectTags))
+	for tag := range cfg.RejectTags {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	var issues []string
+	confidences := TagConfidences(analysis)
+	for _, tag := range tags {
+		if c, ok := confidences[tag]; ok && c >= cfg.RejectTags[tag] {
+			issues = append(issues, fmt.Sprintf("tag %s %.2f", tag, c))
+		}
+	}
+	return issues
+}
+
+// subjectIssue reports an image whose subject, the largest detected object of
+// one of the SubjectClasses, is off-center or close to an edge. Images with
+// no such object pass.
+func subjectIssue(analysis ImageAnalysis, cfg CategorizeConfig) string {
+	if len(cfg.SubjectClasses) == 0 || (cfg.SubjectCenterMax == 0 && cfg.SubjectEdgeMargin == 0) {
+		return ""
+	}
+	var subject *ObjectRectangle
+	for i, obj := range analysis.Objects {
+		if !slices.Contains(cfg.SubjectClasses, obj.Object) || obj.Confidence < cfg.ObjectConfidenceMin {
+			continue
+		}
+		if subject == nil || obj.Rectangle.W*obj.Rectangle.H > subject.W*subject.H {
+			subject = &analysis.Objects[i].Rectangle
+		}
+	}
+	w, h := float64(analysis.Metadata.Width), float64(analysis.Metadata.Height)
+	if subject == nil || w == 0 || h == 0 {
+		return ""
+	}
+
+	if cfg.SubjectEdgeMargin > 0 {
+		mx, my := cfg.SubjectEdgeMargin*w, cfg.SubjectEdgeMargin*h
+		if float64(subject.X) < mx || float64(subject.Y) < my ||
+			float64(subject.X+subject.W) > w-mx || float64(subject.Y+subject.H) > h-my {
+			return "subject at edge"
+		}
+	}
+	if cfg.SubjectCenterMax > 0 {
+		// The offset of the subject's center from the image's, as a
+		// fraction of the distance to the nearest edge in that direction.
+		dx := math.Abs(float64(subject.X)+float64(subject.W)/2-w/2) / (w / 2)
+		dy := math.Abs(float64(subject.Y)+float64(subject.H)/2-h/2) / (h / 2)
+		if offset := max(dx, dy); offset > cfg.SubjectCenterMax {
+			return fmt.Sprintf("subject off-center %.2f", offset)
+		}
+	}
+	return ""
+}
+
+// resolutionIssue reports an image smaller than the configured minimums.
+func resolutionIssue(analysis ImageAnalysis, cfg CategorizeConfig) string {
+	w, h := analysis.Metadata.Width, analysis.Metadata.Height
+	if w < cfg.MinWidth || h < cfg.MinHeight ||
+		max(w, h) < cfg.MinLongEdge || min(w, h) < cfg.MinShortEdge ||
+		float64(w*h)/1e6 < cfg.MinMegapixels {
+		return fmt.Sprintf("resolution %dx%d", w, h)
+	}
+	return ""
+}
+
+// aspectIssue reports an image whose aspect ratio is outside the configured
+// bounds.
+func aspectIssue(analysis ImageAnalysis, cfg CategorizeConfig) string {
+	if cfg.AspectMin == 0 && cfg.AspectMax == 0 {
+		return ""
+	}
+	if analysis.Metadata.Height == 0 {
+		return "aspect unknown"
+	}
+	aspect := float64(analysis.Metadata.Width) / float64(analysis.Metadata.Height)
+	if aspect < cfg.AspectMin || (cfg.AspectMax != 0 && aspect > cfg.AspectMax) {
+		return fmt.Sprintf("aspect %.2f", aspect)
+	}
+	return ""
+}
+
+// dominantColorIssues checks that at least one of the required colors is
+// dominant and none of the rejected ones are. Colors are compared ignoring
+// case, since Azure capitalizes them.
+func dominantColorIssues(color ColorAnalysis, cfg CategorizeConfig) []string {
+	var issues []string
+	if len(cfg.RequireDominantColors) > 0 && !slices.ContainsFunc(cfg.RequireDominantColors, color.hasDominant) {
+		issues = append(issues, "not dominant "+strings.Join(cfg.RequireDominantColors, "/"))
+	}
+	for _, c := range cfg.RejectDominantColors {
+		if color.hasDominant(c) {
+			issues = append(issues, "dominant "+strings.ToLower(c))
+		}
+	}
+	return issues
+}
+
+// ScoreImage rates how good a subject the image is between 0 and 1. Each
+// required rule contributes the confidence of its best matching tag, and the
+// average is scaled down by the fraction of the image covered by objects.
+// A configured Score expression takes the place of this, and isn't bounded.
+func ScoreImage(analysis ImageAnalysis, cfg CategorizeConfig) float64 {
+	tags := TagConfidences(analysis)
+	if cfg.Score != nil {
+		return cfg.Score.Eval(tags)
+	}
+	score := float64(1)
+	if len(cfg.Require) > 0 {
+		total := float64(0)
+		for _, rule := range cfg.Require {
+			total += rule.score(tags)
+		}
+		score = total / float64(len(cfg.Require))
+	}
+	return score * (1 - min(ObjectAreaFraction(analysis, cfg.ObjectConfidenceMin), 1))
+}
+
+// TagConfidences maps the name of each tag in analysis to its confidence.
+func TagConfidences(analysis ImageAnalysis) map[string]float64 {
+	tags := make(map[string]float64)
+	for _, tag := range analysis.Tags {
+		tags[tag.Name] = tag.Confidence
+	}
+	return tags
+}
+
+// generalObjectFraction sums the fractions of the classes counted towards
+// ObjectAreaMax, those neither ignored nor limited separately, and returns the
+// largest of them.
+func generalObjectFraction(classFractions map[string]float64, cfg CategorizeConfig) (float64, string) {
+	total := float64(0)
+	largestClass := ""
+	for class, fraction := range classFractions {
+		if slices.Contains(cfg.IgnoreObjectClasses, class) {
+			continue
+		}
+		if _, ok := cfg.ObjectClassAreaMax[class]; ok {
+			continue
+		}
+		total += fraction
+		if largestClass == "" || fraction > classFractions[largestClass] ||
+			(fraction == classFractions[largestClass] && class < largestClass) {
+			largestClass = class
+		}
+	}
+	return total, largestClass
+}
+
+// ObjectAreaFraction returns the fraction of the image covered by detected
+// objects with at least minConfidence.
+func ObjectAreaFraction(analysis ImageAnalysis, minConfidence float64) float64 {
+	imageArea := float64(analysis.Metadata.Width * analysis.Metadata.Height)
+	objectsArea := float64(0)
+	for _, obj := range analysis.Objects {
+		if obj.Confidence >= minConfidence {
+			objectsArea += float64(obj.Rectangle.W * obj.Rectangle.H)
+		}
+	}
+	return objectsArea / imageArea
+}
+
+// objectClassAreaFractions returns the fraction of the image covered by
+// detected objects of each class with at least minConfidence.
+func objectClassAreaFractions(analysis ImageAnalysis, minConfidence float64) map[string]float64 {
+	imageArea := float64(analysis.Metadata.Width * analysis.Metadata.Height)
+	fractions := make(map[string]float64)
+	for _, obj := range analysis.Objects {
+		if obj.Confidence >= minConfidence {
+			fractions[obj.Object] += float64(obj.Rectangle.W*obj.Rectangle.H) / imageArea
+		}
+	}
+	return fractions
+}
+
+// isFlickrPlaceholder reports whether analysis looks like it was made of the
+// placeholder image: a PNG or GIF, where a real preview is a JPEG or,
+// increasingly, a WebP or AVIF, of the size the placeholder is served at for
+// one of the preview sizes. Real PNG and GIF uploads are previewed at their own
+// shape. This catches analyses cached before the availability check.
+func isFlickrPlaceholder(analysis ImageAnalysis) bool {
+	format := analysis.Metadata.Format
+	if !strings.EqualFold(format, "png") && !strings.EqualFold(format, "gif") {
+		return false
+	}
+	w, h := analysis.Metadata.Width, analysis.Metadata.Height
+	if w == h {
+		return slices.Contains(flickrPlaceholderSquareEdges, w)
+	}
+	// The short edge is rounded, so may be a pixel off three quarters.
+	return slices.Contains(flickrPlaceholderEdges, w) && abs(h-w*3/4) <= 1
+}
+
+// flickrPlaceholderSquareEdges are the edges of the placeholder at the square
+// preview sizes, s and q, and flickrPlaceholderEdges the longest edges of the
+// 4:3 placeholder at the others.
+var flickrPlaceholderSquareEdges = []int{75, 150}
+var flickrPlaceholderEdges = []int{100, 240, 320, 400, 500, 640, 800, 1024}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,335 @@
+package selector
+
+import (
+	"math"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// passingAnalysis returns an analysis that satisfies the default config.
+func passingAnalysis() ImageAnalysis {
+	analysis := ImageAnalysis{
+		Adult: &AdultAnalysis{},
+		Color: &ColorAnalysis{},
+		Tags: []AnalysisTag{
+			{Name: "outdoor", Confidence: 0.9},
+			{Name: "mountain", Confidence: 0.9},
+			{Name: "sky", Confidence: 0.9},
+		},
+	}
+	analysis.Metadata.Width = 400
+	analysis.Metadata.Height = 300
+	analysis.Metadata.Format = "Jpeg"
+	return analysis
+}
+
+// setTag sets the confidence of a tag, adding it if needed, or removes it if
+// confidence is negative.
+func setTag(analysis *ImageAnalysis, name string, confidence float64) {
+	var tags []AnalysisTag
+	for _, tag := range analysis.Tags {
+		if tag.Name != name {
+			tags = append(tags, tag)
+		}
+	}
+	if confidence >= 0 {
+		tags = append(tags, AnalysisTag{Name: name, Confidence: confidence})
+	}
+	analysis.Tags = tags
+}
+
+func TestCategorizeImage(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(a *ImageAnalysis)
+		ok     bool
+		issues string
+	}{
+		{"passes", func(a *ImageAnalysis) {}, true, ""},
+		{"adult", func(a *ImageAnalysis) { a.Adult.IsAdultContent = true }, false, "adult/racy/gory"},
+		{"racy", func(a *ImageAnalysis) { a.Adult.IsRacyContent = true }, false, "adult/racy/gory"},
+		{"gory", func(a *ImageAnalysis) { a.Adult.IsGoryContent = true }, false, "adult/racy/gory"},
+		{"adult unknown", func(a *ImageAnalysis) { a.Adult = nil }, false, "adult/racy/gory unknown"},
+		{"bw", func(a *ImageAnalysis) { a.Color.IsBWImg = true }, false, "bw"},
+		{"bw unknown", func(a *ImageAnalysis) { a.Color = nil }, false, "bw unknown"},
+		{"no outdoor", func(a *ImageAnalysis) { setTag(a, "outdoor", -1) }, false, "!outdoor&&!nature"},
+		{"low outdoor", func(a *ImageAnalysis) { setTag(a, "outdoor", 0.79) }, false, "!outdoor&&!nature"},
+		{"nature", func(a *ImageAnalysis) {
+			setTag(a, "outdoor", -1)
+			setTag(a, "nature", 0.8)
+		}, true, ""},
+		{"no mountain", func(a *ImageAnalysis) { setTag(a, "mountain", 0.3) }, false, "!mountain&&!hill"},
+		{"hill", func(a *ImageAnalysis) {
+			setTag(a, "mountain", -1)
+			setTag(a, "hill", 0.85)
+		}, true, ""},
+		{"no sky", func(a *ImageAnalysis) { setTag(a, "sky", -1) }, false, "!sky&&!landscape"},
+		{"landscape", func(a *ImageAnalysis) {
+			setTag(a, "sky", -1)
+			setTag(a, "landscape", 0.95)
+		}, true, ""},
+		{"small object", func(a *ImageAnalysis) {
+			a.Objects = []AnalysisObject{{Object: "person", Rectangle: ObjectRectangle{W: 100, H: 100}}}
+		}, true, ""},
+		{"large objects", func(a *ImageAnalysis) {
+			a.Objects = []AnalysisObject{
+				{Object: "person", Rectangle: ObjectRectangle{W: 200, H: 150}},
+				{Object: "car", Rectangle: ObjectRectangle{W: 100, H: 60}},
+			}
+		}, false, "objects 30.00% (mostly person)"},
+		{"webp", func(a *ImageAnalysis) { a.Metadata.Format = "Webp" }, true, ""},
+		{"flickr placeholder", func(a *ImageAnalysis) { a.Metadata.Format = "Png" }, false, "flickr placeholder"},
+		{"png upload", func(a *ImageAnalysis) {
+			a.Metadata.Format = "Png"
+			a.Metadata.Width, a.Metadata.Height = 400, 266
+		}, true, ""},
+		{"several issues", func(a *ImageAnalysis) {
+			a.Color.IsBWImg = true
+			setTag(a, "mountain", -1)
+		}, false, "bw,!mountain&&!hill"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis := passingAnalysis()
+			tt.modify(&analysis)
+			ok, issues := CategorizePicture(ManifestEntry{}, analysis, DefaultCategorizeConfig())
+			if ok != tt.ok || issues != tt.issues {
+				t.Errorf("categorizeImage() = %v, %q, want %v, %q", ok, issues, tt.ok, tt.issues)
+			}
+		})
+	}
+}
+
+func TestIssueType(t *testing.T) {
+	tests := map[string]string{
+		"bw":                             "bw",
+		"adult/racy/gory unknown":        "adult/racy/gory unknown",
+		"!mountain&&!hill":               "!mountain&&!hill",
+		"objects 30.00% (mostly person)": "objects",
+		"objects[car] 6.00%":             "objects[car]",
+		"duplicate of 1234 (distance 3)": "duplicate",
+		"not in top 10 (score 0.512)":    "not in top",
+	}
+	for issue, want := range tests {
+		if got := IssueType(issue); got != want {
+			t.Errorf("issueType(%q) = %q, want %q", issue, got, want)
+		}
+	}
+}
+
+func TestParseScoreExpr(t *testing.T) {
+	tags := map[string]float64{"mountain": 0.9, "snow": 0.6, "person": 0.5, "mountain range": 0.8}
+	tests := map[string]float64{
+		"mountain":                              0.9,
+		"mountain + snow - person":              1.0,
+		"2 * snow - person * 2":                 0.2,
+		"-person + 1":                           0.5,
+		"min(mountain, snow) - max(person, .2)": 0.1,
+		"(mountain - snow) * 2":                 0.6,
+		"'mountain range' * missing":            0,
+	}
+	for expr, want := range tests {
+		score, err := ParseScoreExpr(expr)
+		if err != nil {
+			t.Errorf("parseScoreExpr(%q): %v", expr, err)
+			continue
+		}
+		if got := score.Eval(tags); math.Abs(got-want) > 1e-9 {
+			t.Errorf("%q = %v, want %v", expr, got, want)
+		}
+	}
+
+	for _, expr := range []string{"", "mountain +", "min(mountain", "mountain snow", "'mountain", "mountain / 2", "max()"} {
+		if _, err := ParseScoreExpr(expr); err == nil {
+			t.Errorf("parseScoreExpr(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestScoreMin(t *testing.T) {
+	cfg := DefaultCategorizeConfig()
+	cfg.Score, _ = ParseScoreExpr("mountain - person")
+	cfg.ScoreMin = 0.5
+	analysis := passingAnalysis()
+	if ok, issues := CategorizePicture(ManifestEntry{}, analysis, cfg); !ok {
+		t.Errorf("categorizeImage() = false, %q, want true", issues)
+	}
+	setTag(&analysis, "person", 0.6)
+	if ok, issues := CategorizePicture(ManifestEntry{}, analysis, cfg); ok || issues != "score 0.300" {
+		t.Errorf("categorizeImage() = %v, %q, want false, %q", ok, issues, "score 0.300")
+	}
+}
+
+func TestRejectTags(t *testing.T) {
+	cfg := DefaultCategorizeConfig()
+	cfg.RejectTags = map[string]float64{"person": 0.7, "indoor": 0.5}
+	analysis := passingAnalysis()
+	setTag(&analysis, "person", 0.6)
+	if ok, issues := Categorize(analysis, cfg); !ok {
+		t.Errorf("Categorize() = false, %q, want true", issues)
+	}
+	setTag(&analysis, "person", 0.85)
+	setTag(&analysis, "indoor", 0.5)
+	want := "tag indoor 0.50,tag person 0.85"
+	if ok, issues := Categorize(analysis, cfg); ok || issues != want {
+		t.Errorf("Categorize() = %v, %q, want false, %q", ok, issues, want)
+	}
+	if got := IssueType("tag person 0.85"); got != "tag person" {
+		t.Errorf("IssueType() = %q, want %q", got, "tag person")
+	}
+}
+
+func TestMinTags(t *testing.T) {
+	cfg := DefaultCategorizeConfig()
+	cfg.MinTags = 3
+	analysis := passingAnalysis()
+	if ok, issues := Categorize(analysis, cfg); !ok {
+		t.Errorf("Categorize() = false, %q, want true", issues)
+	}
+	setTag(&analysis, "outdoor", -1)
+	setTag(&analysis, "sky", -1)
+	want := "insufficient-analysis (1 tags)"
+	if ok, issues := Categorize(analysis, cfg); ok || issues != want {
+		t.Errorf("Categorize() = %v, %q, want false, %q", ok, issues, want)
+	}
+	if got := IssueType(want); got != "insufficient-analysis" {
+		t.Errorf("IssueType(%q) = %q", want, got)
+	}
+}
+
+func TestAdultScoreMax(t *testing.T) {
+	cfg := DefaultCategorizeConfig()
+	cfg.RacyScoreMax = 0.6
+	score := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name  string
+		adult AdultAnalysis
+		ok    bool
+	}{
+		{"racy flag under max", AdultAnalysis{IsRacyContent: true, RacyScore: score(0.5)}, true},
+		{"racy score over max", AdultAnalysis{RacyScore: score(0.7)}, false},
+		{"racy flag without score", AdultAnalysis{IsRacyContent: true}, false},
+		{"adult flag", AdultAnalysis{IsAdultContent: true, AdultScore: score(0.1)}, false},
+	}
+	for _, tt := range tests {
+		analysis := passingAnalysis()
+		analysis.Adult = &tt.adult
+		if ok, issues := CategorizePicture(ManifestEntry{}, analysis, cfg); ok != tt.ok {
+			t.Errorf("%s: categorizeImage() = %v, %q, want %v", tt.name, ok, issues, tt.ok)
+		}
+	}
+}
+
+func TestObjectConfidenceMin(t *testing.T) {
+	cfg := DefaultCategorizeConfig()
+	cfg.ObjectConfidenceMin = 0.5
+	analysis := passingAnalysis()
+	analysis.Objects = []AnalysisObject{
+		{Object: "person", Confidence: 0.9, Rectangle: ObjectRectangle{W: 200, H: 150}},
+		{Object: "car", Confidence: 0.3, Rectangle: ObjectRectangle{W: 100, H: 60}},
+	}
+	want := "objects 25.00% (mostly person, 30.00% unfiltered)"
+	if ok, issues := CategorizePicture(ManifestEntry{}, analysis, cfg); ok || issues != want {
+		t.Errorf("categorizeImage() = %v, %q, want false, %q", ok, issues, want)
+	}
+	analysis.Objects[0].Confidence = 0.4
+	if ok, issues := CategorizePicture(ManifestEntry{}, analysis, cfg); !ok {
+		t.Errorf("categorizeImage() = false, %q, want true", issues)
+	}
+}
+
+func TestSubjectFraming(t *testing.T) {
+	cfg := DefaultCategorizeConfig()
+	cfg.IgnoreObjectClasses = []string{"mountain"}
+	cfg.SubjectClasses = []string{"mountain"}
+	cfg.SubjectCenterMax = 0.5
+	cfg.SubjectEdgeMargin = 0.05
+	analysis := passingAnalysis()
+	analysis.Objects = []AnalysisObject{
+		{Object: "mountain", Confidence: 0.9, Rectangle: ObjectRectangle{X: 100, Y: 80, W: 200, H: 150}},
+		{Object: "mountain", Confidence: 0.9, Rectangle: ObjectRectangle{X: 0, Y: 0, W: 20, H: 20}},
+	}
+	if ok, issues := CategorizePicture(ManifestEntry{}, analysis, cfg); !ok {
+		t.Errorf("categorizeImage() = false, %q, want true", issues)
+	}
+
+	for rect, want := range map[ObjectRectangle]string{
+		{X: 290, Y: 80, W: 80, H: 150}: "subject off-center 0.65",
+		{X: 100, Y: 5, W: 200, H: 150}: "subject at edge",
+	} {
+		analysis.Objects[0].Rectangle = rect
+		if ok, issues := CategorizePicture(ManifestEntry{}, analysis, cfg); ok || issues != want {
+			t.Errorf("categorizeImage() with subject %+v = %v, %q, want false, %q", rect, ok, issues, want)
+		}
+	}
+}
+
+func TestParseTagGroups(t *testing.T) {
+	rules, err := ParseTagGroups("any:0.8:outdoor,nature; all:0.5:sea, beach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{AnyTagRule(0.8, "outdoor", "nature"), AllTagRule(0.5, "sea", "beach")}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("parseTagGroups() = %+v, want %+v", rules, want)
+	}
+
+	for _, s := range []string{"any:0.8", "some:0.8:sea", "all:high:sea", "any:0.8:,"} {
+		if _, err := ParseTagGroups(s); err == nil {
+			t.Errorf("parseTagGroups(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	cfg := DefaultCategorizeConfig()
+	cfg.RacyScoreMax = 0.4
+	cfg.RejectTags = map[string]float64{"person": 0.7}
+	cfg.MinTags = 2
+	cfg.MinWidth = 300
+	cfg.AspectMax = 2
+	cfg.RejectDominantColors = []string{"Black"}
+	modifications := []func(a *ImageAnalysis){
+		func(a *ImageAnalysis) {},
+		func(a *ImageAnalysis) { setTag(a, "mountain", 0.72) },
+		func(a *ImageAnalysis) { setTag(a, "person", 0.9) },
+		func(a *ImageAnalysis) { setTag(a, "outdoor", -1); setTag(a, "sky", -1) },
+		func(a *ImageAnalysis) { a.Metadata.Width = 200 },
+		func(a *ImageAnalysis) { a.Metadata.Width = 900 },
+		func(a *ImageAnalysis) { a.Metadata.Format = "Png" },
+		func(a *ImageAnalysis) { a.Color.DominantColors = []string{"black"} },
+		func(a *ImageAnalysis) { racy := 0.5; a.Adult.RacyScore = &racy },
+		func(a *ImageAnalysis) {
+			a.Objects = []AnalysisObject{{Object: "person", Rectangle: ObjectRectangle{W: 200, H: 150}}}
+		},
+	}
+	for i, modify := range modifications {
+		analysis := passingAnalysis()
+		modify(&analysis)
+		ok, issues := CategorizePicture(ManifestEntry{}, analysis, cfg)
+		checks := Explain(ManifestEntry{}, analysis, cfg)
+		passed := true
+		for _, check := range checks {
+			passed = passed && (check.Pass || check.Depth > 0)
+		}
+		if passed != ok {
+			t.Errorf("%d: every check passes = %t, but CategorizePicture() = %t, %q; checks %v", i, passed, ok, issues, checks)
+		}
+	}
+
+	analysis := passingAnalysis()
+	setTag(&analysis, "mountain", 0.72)
+	racy := 0.1
+	analysis.Adult.RacyScore = &racy
+	var explained []string
+	for _, check := range Explain(ManifestEntry{}, analysis, cfg) {
+		explained = append(explained, check.String())
+	}
+	for _, want := range []string{"mountain=0.72 < 0.80 FAIL", "racyScore=0.10 < 0.40 PASS", "any(mountain >= 0.80, hill >= 0.80) FAIL"} {
+		if !slices.Contains(explained, want) {
+			t.Errorf("explanation %q doesn't contain %q", explained, want)
+		}
+	}
+}
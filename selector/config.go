@@ -0,0 +1,156 @@
+package selector
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// CategorizeConfig holds the thresholds used by Categorize to decide
+// whether an analyzed image is a suitable subject.
+type CategorizeConfig struct {
+	// RejectAdult rejects images flagged as adult, racy or gory.
+	RejectAdult bool
+	// AdultScoreMax, RacyScoreMax and GoreScoreMax, if set, replace the
+	// provider's flags with a maximum for the corresponding score.
+	AdultScoreMax float64
+	RacyScoreMax  float64
+	GoreScoreMax  float64
+	// RejectBW rejects black and white images.
+	RejectBW bool
+	// ObjectAreaMax is the maximum fraction of the image that may be covered
+	// by detected objects.
+	ObjectAreaMax float64
+	// ObjectClassAreaMax overrides ObjectAreaMax for particular object
+	// classes. Objects of these classes are limited separately and don't
+	// count towards the overall limit.
+	ObjectClassAreaMax map[string]float64
+	// ObjectConfidenceMin is the confidence below which detected objects are
+	// ignored by the area checks, as likely false positives.
+	ObjectConfidenceMin float64
+	// IgnoreObjectClasses lists object classes excluded from the area checks.
+	IgnoreObjectClasses []string
+	// Require lists the tag rules that must all be satisfied.
+	Require []Rule
+	// RejectTags rejects images with any of these tags at or above its
+	// confidence, whatever their other tags.
+	RejectTags map[string]float64
+	// MinTags is the fewest tags an analysis may have for Require to be
+	// checked. Analyses with fewer, as of a blank or corrupt image, are
+	// rejected as insufficient rather than for failing the rules.
+	MinTags int
+	// AllowMissingAdult accepts images whose analysis has no adult content
+	// information rather than rejecting them.
+	AllowMissingAdult bool
+	// AllowMissingColor accepts images whose analysis has no color
+	// information rather than rejecting them.
+	AllowMissingColor bool
+	// RequireDominantColors, if not empty, rejects images that have none of
+	// these among their dominant colors.
+	RequireDominantColors []string
+	// RejectDominantColors rejects images that have any of these among their
+	// dominant colors.
+	RejectDominantColors []string
+	// MinWidth, MinHeight, MinLongEdge and MinShortEdge are minimum
+	// dimensions in pixels, and MinMegapixels a minimum area. Zero disables
+	// each check.
+	MinWidth      int
+	MinHeight     int
+	MinLongEdge   int
+	MinShortEdge  int
+	MinMegapixels float64
+	// AspectMin and AspectMax bound the width divided by the height. Zero
+	// disables each bound.
+	AspectMin float64
+	AspectMax float64
+	// BrandConfidenceMax rejects images with a brand detected above this
+	// confidence. Zero disables the check.
+	BrandConfidenceMax float64
+	// SubjectClasses are the object classes that can be an image's subject.
+	// If set, the largest such object is checked to be at most
+	// SubjectCenterMax from the center, as a fraction of the distance to the
+	// edge, and at least SubjectEdgeMargin, as a fraction of the image size,
+	// from every edge. Zero disables each check.
+	SubjectClasses    []string
+	SubjectCenterMax  float64
+	SubjectEdgeMargin float64
+	// Score, if set, replaces the built-in score used by top selection, and
+	// images it scores below ScoreMin are rejected.
+	Score    *ScoreExpr
+	ScoreMin float64
+}
+
+func DefaultCategorizeConfig() CategorizeConfig {
+	return CategorizeConfig{
+		RejectAdult:   true,
+		RejectBW:      true,
+		ObjectAreaMax: 0.2,
+		Require:       ThresholdRules(0.8, 0.8, 0.8),
+		ScoreMin:      math.Inf(-1),
+	}
+}
+
+// ThresholdRules returns the default tag rules, requiring outdoor or nature,
+// mountain or hill, and sky or landscape at the given confidences.
+func ThresholdRules(outdoor, mountain, sky float64) []Rule {
+	return []Rule{
+		AnyTagRule(outdoor, "outdoor", "nature"),
+		AnyTagRule(mountain, "mountain", "hill"),
+		AnyTagRule(sky, "sky", "landscape"),
+	}
+}
+
+func AnyTagRule(threshold float64, tags ...string) Rule {
+	var rule Rule
+	for _, tag := range tags {
+		rule.Any = append(rule.Any, Rule{Tag: tag, Op: ">=", Value: threshold})
+	}
+	return rule
+}
+
+func AllTagRule(threshold float64, tags ...string) Rule {
+	var rule Rule
+	for _, tag := range tags {
+		rule.All = append(rule.All, Rule{Tag: tag, Op: ">=", Value: threshold})
+	}
+	return rule
+}
+
+// ParseTagGroups parses semicolon-separated groups of the form
+// "mode:threshold:tag,tag,...", where mode is "any" or "all", into rules
+// requiring any or all of the tags at the threshold.
+func ParseTagGroups(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, group := range strings.Split(s, ";") {
+		if group = strings.TrimSpace(group); group == "" {
+			continue
+		}
+		parts := strings.SplitN(group, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("group %q: expected mode:threshold:tags", group)
+		}
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("group %q: invalid threshold", group)
+		}
+		var tags []string
+		for _, tag := range strings.Split(parts[2], ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			return nil, fmt.Errorf("group %q: no tags", group)
+		}
+		switch mode := strings.TrimSpace(parts[0]); mode {
+		case "any":
+			rules = append(rules, AnyTagRule(threshold, tags...))
+		case "all":
+			rules = append(rules, AllTagRule(threshold, tags...))
+		default:
+			return nil, fmt.Errorf("group %q: invalid mode %q, expected any or all", group, mode)
+		}
+	}
+	return rules, nil
+}
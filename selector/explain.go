@@ -0,0 +1,259 @@
+package selector
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Check is one of the checks made in categorizing an image, with the values
+// it compared, to explain why the image was kept or dropped.
+type Check struct {
+	// Name is what was checked, such as a tag or "racyScore".
+	Name string
+	// Value is what the image has, if the check has a value, and Limit what
+	// it was compared with, if anything. Rel is how Value relates to Limit,
+	// such as "<" or "lacks".
+	Value string
+	Rel   string
+	Limit string
+	Pass  bool
+	// Depth is how deeply the check is nested in a combination of Require
+	// rules, whose parts may fail without the combination failing.
+	Depth int
+}
+
+// String formats the check as, for example, "mountain=0.72 < 0.80 FAIL".
+func (c Check) String() string {
+	s := c.Name
+	if c.Value != "" {
+		s += "=" + c.Value
+	}
+	if c.Limit != "" {
+		s += " " + c.Rel + " " + c.Limit
+	}
+	if c.Pass {
+		return s + " PASS"
+	}
+	return s + " FAIL"
+}
+
+// Explain lists every check CategorizePicture makes of a picture, in the same
+// order and whether it passes or not, each combination of rules followed by
+// its parts. The picture passes if every check with a Depth of zero does.
+func Explain(picture ManifestEntry, analysis ImageAnalysis, cfg CategorizeConfig) []Check {
+	checks := ExplainContent(picture, analysis, cfg)
+	tags := TagConfidences(analysis)
+
+	if cfg.MinTags > 0 {
+		n := len(analysis.Tags)
+		checks = append(checks, compare("tags", "%.0f", float64(n), float64(cfg.MinTags), n >= cfg.MinTags))
+	}
+	if len(analysis.Tags) >= cfg.MinTags {
+		for _, rule := range cfg.Require {
+			checks = append(checks, rule.explain(tags, 0)...)
+		}
+	}
+
+	classFractions := objectClassAreaFractions(analysis, cfg.ObjectConfidenceMin)
+	classes := make([]string, 0, len(classFractions))
+	for class := range classFractions {
+		classes = append(classes, class)
+	}
+	slices.Sort(classes)
+	for _, class := range classes {
+		fraction := classFractions[class]
+		if slices.Contains(cfg.IgnoreObjectClasses, class) {
+			continue
+		}
+		if classMax, ok := cfg.ObjectClassAreaMax[class]; ok {
+			checks = append(checks, compare("objects["+class+"]", "%.2f%%", fraction*100, classMax*100, !(fraction > classMax)))
+		}
+	}
+	objectFraction, _ := generalObjectFraction(classFractions, cfg)
+	checks = append(checks, compare("objects", "%.2f%%", objectFraction*100, cfg.ObjectAreaMax*100, !(objectFraction > cfg.ObjectAreaMax)))
+	return checks
+}
+
+// ExplainContent lists the checks ContentIssues makes of a picture, those
+// that rule it out no matter how well it scores.
+func ExplainContent(picture ManifestEntry, analysis ImageAnalysis, cfg CategorizeConfig) []Check {
+	if !picture.IsFlickr() {
+		return explainImage(analysis, cfg)
+	}
+	placeholder := isFlickrPlaceholder(analysis)
+	check := Check{Name: "format", Value: analysis.Metadata.Format, Pass: !placeholder}
+	if placeholder {
+		return []Check{check}
+	}
+	return append([]Check{check}, explainImage(analysis, cfg)...)
+}
+
+// explainImage lists the checks imageIssues makes of an image.
+func explainImage(analysis ImageAnalysis, cfg CategorizeConfig) []Check {
+	var checks []Check
+
+	if cfg.RejectAdult {
+		if a := analysis.Adult; a == nil {
+			checks = append(checks, Check{Name: "adult", Value: "unknown", Pass: cfg.AllowMissingAdult})
+		} else {
+			checks = append(checks,
+				adultCheck("adultScore", "isAdultContent", a.IsAdultContent, a.AdultScore, cfg.AdultScoreMax),
+				adultCheck("racyScore", "isRacyContent", a.IsRacyContent, a.RacyScore, cfg.RacyScoreMax),
+				adultCheck("goreScore", "isGoryContent", a.IsGoryContent, a.GoreScore, cfg.GoreScoreMax))
+		}
+	}
+
+	if cfg.RejectBW {
+		if analysis.Color == nil {
+			checks = append(checks, Check{Name: "bw", Value: "unknown", Pass: cfg.AllowMissingColor})
+		} else {
+			checks = append(checks, Check{Name: "isBWImg", Value: strconv.FormatBool(analysis.Color.IsBWImg), Pass: !analysis.Color.IsBWImg})
+		}
+	}
+
+	if len(cfg.RequireDominantColors) > 0 || len(cfg.RejectDominantColors) > 0 {
+		if color := analysis.Color; color == nil {
+			checks = append(checks, Check{Name: "dominantColors", Value: "unknown", Pass: cfg.AllowMissingColor})
+		} else {
+			colors := strings.Join(color.DominantColors, "/")
+			if len(cfg.RequireDominantColors) > 0 {
+				ok := slices.ContainsFunc(cfg.RequireDominantColors, color.hasDominant)
+				checks = append(checks, Check{Name: "dominantColors", Value: colors, Rel: hasRel(ok), Limit: strings.Join(cfg.RequireDominantColors, "/"), Pass: ok})
+			}
+			for _, c := range cfg.RejectDominantColors {
+				has := color.hasDominant(c)
+				checks = append(checks, Check{Name: "dominantColors", Value: colors, Rel: hasRel(has), Limit: c, Pass: !has})
+			}
+		}
+	}
+
+	if len(cfg.RejectTags) > 0 {
+		tags := make([]string, 0, len(cfg.RejectTags))
+		for tag := range cfg.RejectTags {
+			tags = append(tags, tag)
+		}
+		slices.Sort(tags)
+		confidences := TagConfidences(analysis)
+		for _, tag := range tags {
+			c, ok := confidences[tag]
+			checks = append(checks, compare(tag, "%.2f", c, cfg.RejectTags[tag], !(ok && c >= cfg.RejectTags[tag])))
+		}
+	}
+
+	w, h := analysis.Metadata.Width, analysis.Metadata.Height
+	for _, dim := range []struct {
+		name       string
+		value, min int
+	}{
+		{"width", w, cfg.MinWidth},
+		{"height", h, cfg.MinHeight},
+		{"longEdge", max(w, h), cfg.MinLongEdge},
+		{"shortEdge", min(w, h), cfg.MinShortEdge},
+	} {
+		if dim.min > 0 {
+			checks = append(checks, compare(dim.name, "%.0f", float64(dim.value), float64(dim.min), dim.value >= dim.min))
+		}
+	}
+	if cfg.MinMegapixels > 0 {
+		mp := float64(w*h) / 1e6
+		checks = append(checks, compare("megapixels", "%.2f", mp, cfg.MinMegapixels, !(mp < cfg.MinMegapixels)))
+	}
+
+	if cfg.AspectMin != 0 || cfg.AspectMax != 0 {
+		if h == 0 {
+			checks = append(checks, Check{Name: "aspect", Value: "unknown"})
+		} else {
+			aspect := float64(w) / float64(h)
+			if cfg.AspectMin != 0 {
+				checks = append(checks, compare("aspect", "%.2f", aspect, cfg.AspectMin, !(aspect < cfg.AspectMin)))
+			}
+			if cfg.AspectMax != 0 {
+				checks = append(checks, compare("aspect", "%.2f", aspect, cfg.AspectMax, !(aspect > cfg.AspectMax)))
+			}
+		}
+	}
+
+	if cfg.Score != nil {
+		score := cfg.Score.Eval(TagConfidences(analysis))
+		checks = append(checks, compare("score", "%.3f", score, cfg.ScoreMin, !(score < cfg.ScoreMin)))
+	}
+
+	if cfg.BrandConfidenceMax > 0 {
+		for _, brand := range analysis.Brands {
+			checks = append(checks, compare("brand["+brand.Name+"]", "%.2f", brand.Confidence, cfg.BrandConfidenceMax, !(brand.Confidence > cfg.BrandConfidenceMax)))
+		}
+	}
+
+	if len(cfg.SubjectClasses) > 0 && (cfg.SubjectCenterMax != 0 || cfg.SubjectEdgeMargin != 0) {
+		issue := subjectIssue(analysis, cfg)
+		checks = append(checks, Check{Name: "subject", Value: issue, Pass: issue == ""})
+	}
+
+	return checks
+}
+
+// explain lists the comparison of the rule's tag, or for a combination
+// whether it is satisfied as a whole followed by each of its parts one level
+// deeper.
+func (r Rule) explain(tags map[string]float64, depth int) []Check {
+	ok, _ := r.eval(tags)
+	if r.Tag != "" {
+		check := compare(r.Tag, "%.2f", tags[r.Tag], r.Value, ok)
+		check.Depth = depth
+		return []Check{check}
+	}
+	checks := []Check{{Name: r.describe(), Pass: ok, Depth: depth}}
+	for _, child := range append(r.All, r.Any...) {
+		checks = append(checks, child.explain(tags, depth+1)...)
+	}
+	return checks
+}
+
+// describe returns the rule's Name, or else writes it out, as in
+// "any(mountain >= 0.80, hill >= 0.80)".
+func (r Rule) describe() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	if r.Tag != "" {
+		return fmt.Sprintf("%s %s %.2f", r.Tag, r.Op, r.Value)
+	}
+	op, children := "all", r.All
+	if r.All == nil {
+		op, children = "any", r.Any
+	}
+	described := make([]string, len(children))
+	for i, child := range children {
+		described[i] = child.describe()
+	}
+	return op + "(" + strings.Join(described, ", ") + ")"
+}
+
+// adultCheck checks a score against its maximum, or if there is none or no
+// score was recorded, the provider's own flag, as AdultAnalysis.flagged does.
+func adultCheck(scoreName, flagName string, flag bool, score *float64, scoreMax float64) Check {
+	if scoreMax > 0 && score != nil {
+		return compare(scoreName, "%.2f", *score, scoreMax, !(*score > scoreMax))
+	}
+	return Check{Name: flagName, Value: strconv.FormatBool(flag), Pass: !flag}
+}
+
+// compare returns a check of value against limit, both formatted with format.
+func compare(name, format string, value, limit float64, pass bool) Check {
+	rel := "="
+	if value < limit {
+		rel = "<"
+	} else if value > limit {
+		rel = ">"
+	}
+	return Check{Name: name, Value: fmt.Sprintf(format, value), Rel: rel, Limit: fmt.Sprintf(format, limit), Pass: pass}
+}
+
+func hasRel(has bool) string {
+	if has {
+		return "has"
+	}
+	return "lacks"
+}
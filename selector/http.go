@@ -0,0 +1,10 @@
+package selector
+
+import (
+	"net/http"
+	"time"
+)
+
+// HTTPClient sends the requests to Azure when an AzureProvider has no Client
+// of its own.
+var HTTPClient = &http.Client{Timeout: 30 * time.Second}
@@ -0,0 +1,256 @@
+package selector
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+)
+
+type ManifestEntry struct {
+	ID     string `json:"id"`
+	Owner  string `json:"owner"`
+	Secret string `json:"secret"`
+	Server string `json:"server"`
+	Title  string `json:"title"`
+	// PreviewURL and WebURL, if set, locate a picture from a source other
+	// than Flickr, in place of the URLs built from the Flickr fields.
+	PreviewURL string `json:"previewUrl,omitempty"`
+	WebURL     string `json:"webUrl,omitempty"`
+	// Path, if set, is a local image file to upload for analysis instead,
+	// relative to the working directory.
+	Path string `json:"path,omitempty"`
+}
+
+// IsFlickr reports whether the picture is hosted by Flickr, so that Flickr's
+// APIs and conventions apply to it.
+func (e ManifestEntry) IsFlickr() bool {
+	return e.PreviewURL == "" && e.Path == ""
+}
+
+// LocalImageURL returns the file URL of the local image at path.
+func LocalImageURL(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// LocalImagePath returns the path of the local image imageURL refers to, if
+// it is a file URL.
+func LocalImagePath(imageURL string) (string, bool) {
+	u, err := url.Parse(imageURL)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return filepath.FromSlash(u.Path), true
+}
+
+// FlickrImageHost is the host Flickr serves previews from.
+const FlickrImageHost = "live.staticflickr.com"
+
+// FlickrPreviewSizes are the size suffixes that can be requested with a
+// photo's public secret.
+var FlickrPreviewSizes = []string{"s", "q", "t", "m", "n", "w", "z", "c", "b"}
+
+// PreviewURL returns the URL of the preview image that is sent for analysis:
+// the entry's local file or PreviewURL if it has one, otherwise a Flickr
+// preview of the given size served from host, usually FlickrImageHost. The
+// size suffixes map to the longest edge as follows:
+//
+//	s  75px square
+//	q  150px square
+//	t  100px
+//	m  240px
+//	n  320px
+//	w  400px
+//	z  640px
+//	c  800px
+//	b  1024px
+func PreviewURL(photo ManifestEntry, host, size string) string {
+	if photo.Path != "" {
+		return LocalImageURL(photo.Path)
+	}
+	if photo.PreviewURL != "" {
+		return photo.PreviewURL
+	}
+	// https://live.staticflickr.com/{server-id}/{id}_{secret}_{size-suffix}.jpg
+	return "https://" + host + "/" + photo.Server + "/" + photo.ID + "_" + photo.Secret + "_" + size + ".jpg"
+}
+
+// WebURL returns the page to link to the picture from: the entry's WebURL if
+// it has one, its image if it isn't from Flickr, or its Flickr photo page.
+func WebURL(photo ManifestEntry) string {
+	if photo.WebURL != "" {
+		return photo.WebURL
+	}
+	if photo.Path != "" {
+		return LocalImageURL(photo.Path)
+	}
+	if photo.PreviewURL != "" {
+		return photo.PreviewURL
+	}
+	// https://www.flickr.com/photos/{owner-id}/{photo-id}
+	return "https://www.flickr.com/photos/" + photo.Owner + "/" + photo.ID
+}
+
+// ParseManifestFile reads the whole manifest at path into memory. Prefer
+// StreamManifestFile for large manifests.
+func ParseManifestFile(path string) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	err := StreamManifestFile(path, func(entry ManifestEntry) bool {
+		entries = append(entries, entry)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// StreamManifestFile decodes the manifest at path one element at a time,
+// calling yield with each entry until it returns false. The manifest is
+// either a JSON array of entries or JSON Lines, one entry to a line, told
+// apart by its first non-whitespace byte. An empty file has no entries.
+func StreamManifestFile(path string, yield func(ManifestEntry) bool) error {
+	f, err := OpenManifest(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := maybeGunzip(f)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if first == '{' {
+		return streamManifestLines(path, br, yield)
+	}
+
+	dec := json.NewDecoder(br)
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("%s: expected array, got %v", path, tok)
+	}
+	for dec.More() {
+		var entry ManifestEntry
+		if err := dec.Decode(&entry); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if !yield(entry) {
+			return nil
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// streamManifestLines decodes a JSON Lines manifest from r.
+func streamManifestLines(path string, r io.Reader, yield func(ManifestEntry) bool) error {
+	dec := json.NewDecoder(r)
+	for {
+		var entry ManifestEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if !yield(entry) {
+			return nil
+		}
+	}
+}
+
+// peekNonSpace skips any whitespace at the start of br and returns the byte
+// after it without consuming it.
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, br.UnreadByte()
+	}
+}
+
+// OpenManifest opens the manifest at path, which is either a local file or an
+// http(s) URL. URLs are fetched with the transport of HTTPClient, and so any
+// proxy it has, but without its timeout, since a manifest is read while it is
+// processed.
+func OpenManifest(path string) (io.ReadCloser, error) {
+	if !isURL(path) {
+		return os.Open(path)
+	}
+	client := &http.Client{Transport: HTTPClient.Transport}
+	resp, err := client.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: HTTP status %d", path, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// maybeGunzip transparently decompresses r if it starts with the gzip magic
+// bytes.
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// ManifestRegion returns the name of the region the manifest at path is for,
+// taken from the file name or the last segment of the URL without its
+// extensions.
+func ManifestRegion(path string) string {
+	name := filepath.Base(path)
+	if isURL(path) {
+		if u, err := url.Parse(path); err == nil {
+			name = pathpkg.Base(u.Path)
+		}
+	}
+	name = strings.TrimSuffix(name, ".gz")
+	for _, ext := range []string{".json", ".ndjson", ".jsonl"} {
+		if trimmed, ok := strings.CutSuffix(name, ext); ok {
+			return trimmed
+		}
+	}
+	return name
+}
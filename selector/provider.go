@@ -0,0 +1,36 @@
+package selector
+
+import (
+	"context"
+	"errors"
+)
+
+// VisionProvider analyzes an image for categorization.
+type VisionProvider interface {
+	// Name identifies the provider, and any version of its API that affects
+	// the analysis, in cached analyses.
+	Name() string
+	Analyze(ctx context.Context, imageURL string) (ImageAnalysis, error)
+	// Check verifies that the provider is reachable and accepts our
+	// credentials, without analyzing an image.
+	Check(ctx context.Context) error
+}
+
+// PermanentError is returned by a VisionProvider when the image can never be
+// analyzed, for example because it no longer exists.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func IsPermanentError(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
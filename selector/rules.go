@@ -0,0 +1,228 @@
+package selector
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// RuleSet is the contents of a RULES_FILE. Fields that are omitted keep the
+// value configured from the environment.
+type RuleSet struct {
+	RejectAdult   *bool    `json:"rejectAdult"`
+	RejectBW      *bool    `json:"rejectBW"`
+	AdultScoreMax *float64 `json:"adultScoreMax"`
+	RacyScoreMax  *float64 `json:"racyScoreMax"`
+	GoreScoreMax  *float64 `json:"goreScoreMax"`
+	ObjectAreaMax *float64 `json:"objectAreaMax"`
+	// ObjectConfidenceMin is the confidence below which objects are ignored.
+	ObjectConfidenceMin *float64 `json:"objectConfidenceMin"`
+	// ObjectClassAreaMax and IgnoreObjectClasses replace the corresponding
+	// settings when present.
+	ObjectClassAreaMax  map[string]float64 `json:"objectClassAreaMax"`
+	IgnoreObjectClasses []string           `json:"ignoreObjectClasses"`
+	Require             []Rule             `json:"require"`
+	// RejectTags replaces the corresponding setting when present.
+	RejectTags map[string]float64 `json:"rejectTags"`
+	// RequireDominantColors and RejectDominantColors replace the
+	// corresponding settings when present.
+	RequireDominantColors []string `json:"requireDominantColors"`
+	RejectDominantColors  []string `json:"rejectDominantColors"`
+	// Score is a ScoreExpr, and images it scores below ScoreMin are rejected.
+	Score    *string  `json:"score"`
+	ScoreMin *float64 `json:"scoreMin"`
+	score    *ScoreExpr
+}
+
+// Rule is a condition on an image's tag confidences. It is either a single
+// comparison (Tag, Op and Value) or a combination of rules that must All or
+// Any be satisfied.
+type Rule struct {
+	// Name, if set, is reported as the issue when the rule fails.
+	Name  string  `json:"name,omitempty"`
+	Tag   string  `json:"tag,omitempty"`
+	Op    string  `json:"op,omitempty"`
+	Value float64 `json:"value,omitempty"`
+	All   []Rule  `json:"all,omitempty"`
+	Any   []Rule  `json:"any,omitempty"`
+}
+
+func ReadRuleSet(fname string) (RuleSet, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return RuleSet{}, err
+	}
+	var rules RuleSet
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return RuleSet{}, fmt.Errorf("%s: %w", fname, err)
+	}
+	for _, rule := range rules.Require {
+		if err := rule.validate(); err != nil {
+			return RuleSet{}, fmt.Errorf("%s: %w", fname, err)
+		}
+	}
+	if rules.Score != nil {
+		if rules.score, err = ParseScoreExpr(*rules.Score); err != nil {
+			return RuleSet{}, fmt.Errorf("%s: score: %w", fname, err)
+		}
+	}
+	return rules, nil
+}
+
+// Apply overrides the parts of cfg the rule set specifies.
+func (s RuleSet) Apply(cfg *CategorizeConfig) {
+	if s.RejectAdult != nil {
+		cfg.RejectAdult = *s.RejectAdult
+	}
+	if s.RejectBW != nil {
+		cfg.RejectBW = *s.RejectBW
+	}
+	if s.AdultScoreMax != nil {
+		cfg.AdultScoreMax = *s.AdultScoreMax
+	}
+	if s.RacyScoreMax != nil {
+		cfg.RacyScoreMax = *s.RacyScoreMax
+	}
+	if s.GoreScoreMax != nil {
+		cfg.GoreScoreMax = *s.GoreScoreMax
+	}
+	if s.ObjectAreaMax != nil {
+		cfg.ObjectAreaMax = *s.ObjectAreaMax
+	}
+	if s.ObjectConfidenceMin != nil {
+		cfg.ObjectConfidenceMin = *s.ObjectConfidenceMin
+	}
+	if s.ObjectClassAreaMax != nil {
+		cfg.ObjectClassAreaMax = s.ObjectClassAreaMax
+	}
+	if s.IgnoreObjectClasses != nil {
+		cfg.IgnoreObjectClasses = s.IgnoreObjectClasses
+	}
+	if s.Require != nil {
+		cfg.Require = s.Require
+	}
+	if s.RejectTags != nil {
+		cfg.RejectTags = s.RejectTags
+	}
+	if s.RequireDominantColors != nil {
+		cfg.RequireDominantColors = s.RequireDominantColors
+	}
+	if s.RejectDominantColors != nil {
+		cfg.RejectDominantColors = s.RejectDominantColors
+	}
+	if s.score != nil {
+		cfg.Score = s.score
+	}
+	if s.ScoreMin != nil {
+		cfg.ScoreMin = *s.ScoreMin
+	}
+}
+
+func (r Rule) validate() error {
+	kinds := 0
+	if r.Tag != "" {
+		kinds++
+		switch r.Op {
+		case ">=", ">", "<=", "<":
+		default:
+			return fmt.Errorf("rule on tag %q: invalid op %q", r.Tag, r.Op)
+		}
+	}
+	if r.All != nil {
+		kinds++
+	}
+	if r.Any != nil {
+		kinds++
+	}
+	if kinds != 1 {
+		return fmt.Errorf("rule must have exactly one of tag, all or any")
+	}
+	for _, child := range append(r.All, r.Any...) {
+		if err := child.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eval reports whether tags satisfy the rule, and if not, describes why.
+func (r Rule) eval(tags map[string]float64) (bool, string) {
+	ok, issue := r.evalUnnamed(tags)
+	if !ok && r.Name != "" {
+		issue = r.Name
+	}
+	return ok, issue
+}
+
+func (r Rule) evalUnnamed(tags map[string]float64) (bool, string) {
+	switch {
+	case r.Tag != "":
+		v := tags[r.Tag]
+		var ok bool
+		switch r.Op {
+		case ">=":
+			ok = v >= r.Value
+		case ">":
+			ok = v > r.Value
+		case "<=":
+			ok = v <= r.Value
+		case "<":
+			ok = v < r.Value
+		}
+		if ok {
+			return true, ""
+		}
+		// A failed lower bound means the tag is missing, a failed upper bound
+		// means it is present.
+		if r.Op == ">=" || r.Op == ">" {
+			return false, "!" + r.Tag
+		}
+		return false, r.Tag
+
+	case r.All != nil:
+		var failed []string
+		for _, child := range r.All {
+			if ok, issue := child.eval(tags); !ok {
+				failed = append(failed, issue)
+			}
+		}
+		return len(failed) == 0, strings.Join(failed, "&&")
+
+	default:
+		failed := make([]string, 0, len(r.Any))
+		for _, child := range r.Any {
+			ok, issue := child.eval(tags)
+			if ok {
+				return true, ""
+			}
+			failed = append(failed, issue)
+		}
+		return false, strings.Join(failed, "&&")
+	}
+}
+
+// score rates how well tags satisfy the rule between 0 and 1, ignoring the
+// thresholds: a lower bound scores the tag's confidence and an upper bound
+// its complement.
+func (r Rule) score(tags map[string]float64) float64 {
+	switch {
+	case r.Tag != "":
+		if r.Op == ">=" || r.Op == ">" {
+			return tags[r.Tag]
+		}
+		return 1 - tags[r.Tag]
+	case r.All != nil:
+		score := float64(1)
+		for _, child := range r.All {
+			score = min(score, child.score(tags))
+		}
+		return score
+	default:
+		score := float64(0)
+		for _, child := range r.Any {
+			score = max(score, child.score(tags))
+		}
+		return score
+	}
+}
@@ -0,0 +1,221 @@
+package selector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ScoreExpr is an arithmetic expression over tag confidences, such as
+// "min(mountain, snow) - person". It supports numbers, tag names, +, -, *,
+// parentheses and the functions min and max. Tag names that aren't plain
+// words can be quoted, as in 'mountain range'. Tags missing from an analysis
+// have confidence 0.
+type ScoreExpr struct {
+	Source string
+	eval   func(tags map[string]float64) float64
+}
+
+// Eval computes the score of an image with the given tag confidences.
+func (e *ScoreExpr) Eval(tags map[string]float64) float64 {
+	return e.eval(tags)
+}
+
+func ParseScoreExpr(s string) (*ScoreExpr, error) {
+	tokens, err := scanScoreExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &scoreParser{tokens: tokens}
+	eval, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	return &ScoreExpr{Source: s, eval: eval}, nil
+}
+
+// scanScoreExpr splits s into numbers, names, quoted names (with their
+// quotes) and single-character operators.
+func scanScoreExpr(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("+-*(),", c):
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexRune(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote at %d", i)
+			}
+			tokens = append(tokens, s[i:i+end+2])
+			i += end + 2
+		case isScoreNameRune(c) || c == '.':
+			start := i
+			for i < len(s) && (isScoreNameRune(rune(s[i])) || s[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, s[start:i])
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+func isScoreNameRune(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+type scoreFunc = func(tags map[string]float64) float64
+
+// scoreParser is a recursive descent parser of the grammar
+//
+//	sum     = product { ("+" | "-") product }
+//	product = unary { "*" unary }
+//	unary   = "-" unary | primary
+//	primary = number | name | quoted | ("min" | "max") "(" sum { "," sum } ")" | "(" sum ")"
+type scoreParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *scoreParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *scoreParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *scoreParser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		if got == "" {
+			return fmt.Errorf("expected %q at end", tok)
+		}
+		return fmt.Errorf("expected %q, got %q", tok, got)
+	}
+	return nil
+}
+
+func (p *scoreParser) sum() (scoreFunc, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.next()
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == "+" {
+			left = func(tags map[string]float64) float64 { return l(tags) + right(tags) }
+		} else {
+			left = func(tags map[string]float64) float64 { return l(tags) - right(tags) }
+		}
+	}
+	return left, nil
+}
+
+func (p *scoreParser) product() (scoreFunc, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "*" {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(tags map[string]float64) float64 { return l(tags) * right(tags) }
+	}
+	return left, nil
+}
+
+func (p *scoreParser) unary() (scoreFunc, error) {
+	if p.peek() == "-" {
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(tags map[string]float64) float64 { return -operand(tags) }, nil
+	}
+	return p.primary()
+}
+
+func (p *scoreParser) primary() (scoreFunc, error) {
+	tok := p.next()
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end")
+	case tok == "(":
+		inner, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case tok[0] == '\'' || tok[0] == '"':
+		tag := tok[1 : len(tok)-1]
+		return func(tags map[string]float64) float64 { return tags[tag] }, nil
+	case tok[0] == '.' || unicode.IsDigit(rune(tok[0])):
+		v, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", tok)
+		}
+		return func(map[string]float64) float64 { return v }, nil
+	case (tok == "min" || tok == "max") && p.peek() == "(":
+		return p.call(tok)
+	case isScoreNameRune(rune(tok[0])):
+		return func(tags map[string]float64) float64 { return tags[tok] }, nil
+	default:
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+}
+
+// call parses the arguments of min or max.
+func (p *scoreParser) call(name string) (scoreFunc, error) {
+	p.next()
+	var args []scoreFunc
+	for {
+		arg, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return func(tags map[string]float64) float64 {
+		v := args[0](tags)
+		for _, arg := range args[1:] {
+			if name == "min" {
+				v = min(v, arg(tags))
+			} else {
+				v = max(v, arg(tags))
+			}
+		}
+		return v
+	}, nil
+}
@@ -0,0 +1,19 @@
+package selector
+
+import "context"
+
+// TextDetector is implemented by vision providers that can find text in an
+// image.
+type TextDetector interface {
+	DetectText(ctx context.Context, imageURL string) (TextAnalysis, error)
+}
+
+// TextAnalysis is the text found in an image.
+type TextAnalysis struct {
+	Lines []TextLine `json:"lines"`
+}
+
+type TextLine struct {
+	Text      string          `json:"text"`
+	Rectangle ObjectRectangle `json:"rectangle"`
+}
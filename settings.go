@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// settingsRead records the name of every setting looked up, so that those
+// set in the config file but never used can be reported.
+var settingsRead = make(map[string]bool)
+
+// settingSources records where each setting that was set came from.
+var settingSources = make(map[string]string)
+
+// configFile is the YAML file of settings, CONFIG_FILE or config.yaml, and
+// fileSettings the names of the settings it set.
+var configFile string
+var fileSettings []string
+
+// getenv looks up a setting, which the environment, the .env files or the
+// config file may have set.
+func getenv(name string) string {
+	settingsRead[name] = true
+	return os.Getenv(name)
+}
+
+// loadEnvironment sets up the environment that settings are read from: the
+// process's own, then .env and .local.env, then the config file, each only
+// filling in what the earlier ones leave unset. Any of the files may be
+// missing, except a CONFIG_FILE that is named explicitly.
+func loadEnvironment() {
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		settingSources[name] = "environment"
+	}
+
+	for _, fname := range []string{".env", ".local.env"} {
+		env, err := godotenv.Read(fname)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			log.Fatal("Error loading .env file", err)
+		}
+		for name, value := range env {
+			if _, ok := settingSources[name]; !ok {
+				os.Setenv(name, value)
+				settingSources[name] = fname
+			}
+		}
+	}
+
+	configFile = os.Getenv("CONFIG_FILE")
+	required := configFile != ""
+	if !required {
+		configFile = "config.yaml"
+	}
+	settings, err := readConfigFile(configFile)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		configFile = ""
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	for name, value := range settings {
+		fileSettings = append(fileSettings, name)
+		if _, ok := settingSources[name]; !ok {
+			os.Setenv(name, value)
+			settingSources[name] = configFile
+		}
+	}
+	slices.Sort(fileSettings)
+}
+
+// readConfigFile reads a YAML mapping of setting names to values. Names may
+// be written in lower case, lists become comma-separated values and mappings
+// key:value pairs, in the same form as the environment variables.
+func readConfigFile(fname string) (map[string]string, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	settings := make(map[string]string, len(doc))
+	for key, v := range doc {
+		name := strings.ToUpper(key)
+		if name == "CONFIG_FILE" {
+			return nil, fmt.Errorf("%s: CONFIG_FILE can't be set in the config file", fname)
+		}
+		value, err := settingValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", fname, key, err)
+		}
+		settings[name] = value
+	}
+	return settings, nil
+}
+
+func settingValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := settingValue(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", fmt.Errorf("list item %q contains a comma", s)
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		items := make([]string, len(keys))
+		for i, k := range keys {
+			s, err := settingValue(v[k])
+			if err != nil {
+				return "", err
+			}
+			items[i] = k + ":" + s
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+// reportSettings logs the settings that were set and where from, once they
+// have all been read, and warns about those in the config file that weren't
+// used. Secrets are left out.
+func reportSettings() {
+	var names []string
+	for name := range settingsRead {
+		if _, ok := settingSources[name]; ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		value := os.Getenv(name)
+		if isSecretSetting(name) {
+			value = "(hidden)"
+		} else if strings.HasSuffix(name, "PROXY") || name == "PROXY_URL" {
+			// Proxy URLs may carry a password.
+			if u, err := url.Parse(value); err == nil && u.User != nil {
+				value = u.Redacted()
+			}
+		}
+		infof("Setting %s=%s from %s", name, value, settingSources[name])
+	}
+	for _, name := range fileSettings {
+		if !settingsRead[name] {
+			warnf("%s sets %s, which isn't used", configFile, name)
+		}
+	}
+}
+
+func isSecretSetting(name string) bool {
+	for _, s := range []string{"KEY", "TOKEN", "SECRET", "PASSWORD", "WEBHOOK"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunSummary is written to out/run-summary.json at the end of a run so that
+// scripts can check how each region did.
+type RunSummary struct {
+	Time    time.Time                `json:"time"`
+	Regions map[string]RegionSummary `json:"regions"`
+	Total   RegionSummary            `json:"total"`
+	// ExitCode is the status the run exited with.
+	ExitCode int `json:"exitCode"`
+
+	mu sync.Mutex
+}
+
+// The exit statuses of a run, so that schedulers can tell its outcomes apart.
+// Configuration and other errors that stop a run outright exit with status 1,
+// as log.Fatal does. When several apply the earliest listed here is used.
+const (
+	// exitOK means every region reached its target.
+	exitOK = 0
+	// exitInterrupted means the run was interrupted by a signal.
+	exitInterrupted = 130
+	// exitErrors means some entries were skipped due to errors, such as
+	// failed analysis requests, so a later run may select more.
+	exitErrors = 3
+	// exitStopped means the run stopped at MAX_RUNTIME before every region
+	// was done.
+	exitStopped = 4
+	// exitShortfall means every region was processed to the end but some
+	// ran out of entries short of their target.
+	exitShortfall = 2
+)
+
+// exitCode returns the status the run should exit with.
+func (s *RunSummary) exitCode(interrupted bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case interrupted:
+		return exitInterrupted
+	case s.Total.ErrorCount > 0:
+		return exitErrors
+	case s.Total.Interrupted:
+		return exitStopped
+	case s.Total.Shortfall > 0:
+		return exitShortfall
+	}
+	return exitOK
+}
+
+// RegionSummary counts what happened while processing a region, or across
+// every region in RunSummary.Total. Rejections counts the issues pictures
+// were rejected for by selector.IssueType.
+type RegionSummary struct {
+	Processed    int            `json:"processed"`
+	OKCount      int            `json:"okCount"`
+	Target       int            `json:"target"`
+	APICallCount int            `json:"apiCallCount"`
+	ErrorCount   int            `json:"errorCount"`
+	Rejections   map[string]int `json:"rejections"`
+	// CacheHits counts the entries whose analysis was cached, including
+	// cached failures, and CacheMisses those that weren't, whether they were
+	// then analyzed or skipped for DRY_RUN or MAX_API_CALLS. CacheHitRatio
+	// is the fraction that were hits.
+	CacheHits     int     `json:"cacheHits"`
+	CacheMisses   int     `json:"cacheMisses"`
+	CacheHitRatio float64 `json:"cacheHitRatio"`
+	// Interrupted is set if processing stopped early because of a signal.
+	Interrupted bool `json:"interrupted,omitempty"`
+	// Shortfall is how many pictures short of Target a region that was
+	// processed to the end finished.
+	Shortfall int `json:"shortfall,omitempty"`
+	// EmptyManifest is set if the region's manifest had no entries.
+	EmptyManifest bool `json:"emptyManifest,omitempty"`
+}
+
+func newRunSummary() *RunSummary {
+	return &RunSummary{
+		Regions: make(map[string]RegionSummary),
+		Total:   RegionSummary{Rejections: make(map[string]int)},
+	}
+}
+
+// add records the summary of region. It is safe to call concurrently.
+func (s *RunSummary) add(region string, r RegionSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Regions[region] = r
+	s.Total.Processed += r.Processed
+	s.Total.OKCount += r.OKCount
+	s.Total.Target += r.Target
+	s.Total.APICallCount += r.APICallCount
+	s.Total.CacheHits += r.CacheHits
+	s.Total.CacheMisses += r.CacheMisses
+	s.Total.CacheHitRatio = cacheHitRatio(s.Total.CacheHits, s.Total.CacheMisses)
+	s.Total.ErrorCount += r.ErrorCount
+	for issue, n := range r.Rejections {
+		s.Total.Rejections[issue] += n
+	}
+	s.Total.Interrupted = s.Total.Interrupted || r.Interrupted
+	s.Total.Shortfall += r.Shortfall
+}
+
+// cacheHitRatio returns the fraction of lookups that were hits, or zero if
+// there were none.
+func cacheHitRatio(hits, misses int) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// formatCacheCounts describes cache hits and misses on one line, such as
+// "450 hits, 50 misses (90.0% hits)".
+func formatCacheCounts(hits, misses int) string {
+	return fmt.Sprintf("%d hits, %d misses (%.1f%% hits)", hits, misses, cacheHitRatio(hits, misses)*100)
+}
+
+// issuesByCount returns the issues in rejections, most frequent first and
+// otherwise in alphabetical order.
+func issuesByCount(rejections map[string]int) []string {
+	issues := make([]string, 0, len(rejections))
+	for issue := range rejections {
+		issues = append(issues, issue)
+	}
+	slices.SortFunc(issues, func(a, b string) int {
+		if rejections[a] != rejections[b] {
+			return rejections[b] - rejections[a]
+		}
+		return strings.Compare(a, b)
+	})
+	return issues
+}
+
+// formatRejections describes rejections on one line, such as
+// "120 !mountain&&!hill, 45 bw, 12 objects".
+func formatRejections(rejections map[string]int) string {
+	issues := issuesByCount(rejections)
+	for i, issue := range issues {
+		issues[i] = fmt.Sprintf("%d %s", rejections[issue], issue)
+	}
+	return strings.Join(issues, ", ")
+}
+
+// shortRegions returns the regions that finished short of their target, in
+// alphabetical order.
+func (s *RunSummary) shortRegions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var regions []string
+	for region, r := range s.Regions {
+		if r.Shortfall > 0 {
+			regions = append(regions, region)
+		}
+	}
+	slices.Sort(regions)
+	return regions
+}
+
+// erroredRegions returns the regions where entries were skipped due to
+// errors, in alphabetical order.
+func (s *RunSummary) erroredRegions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var regions []string
+	for region, r := range s.Regions {
+		if r.ErrorCount > 0 {
+			regions = append(regions, region)
+		}
+	}
+	slices.Sort(regions)
+	return regions
+}
+
+func (s *RunSummary) write(fname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Time = time.Now().UTC()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(fname, buf.Bytes(), 0640); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// textAreaMax is the maximum fraction of an image that may be covered by
+// text, to reject annotated maps and watermarked photos. Zero disables the
+// check, which needs an extra request for each image that otherwise passes.
+var textAreaMax float64
+
+func loadTextConfig() {
+	textAreaMax = envFloat("TEXT_AREA_MAX", 0)
+	if textAreaMax < 0 || textAreaMax > 1 {
+		log.Fatal("invalid TEXT_AREA_MAX ", textAreaMax)
+	}
+	if textAreaMax == 0 {
+		return
+	}
+	if p, ok := visionProvider.(*selector.AzureProvider); ok && p.APIVersion != "3.1" {
+		log.Fatal("TEXT_AREA_MAX requires AZURE_API_VERSION=3.1")
+	}
+	if _, ok := visionProvider.(selector.TextDetector); !ok {
+		log.Fatal("TEXT_AREA_MAX is not supported by the vision provider")
+	}
+}
+
+// requestTextDetection finds the text in imageURL, a picture of region, with
+// the region's provider, giving up after ANALYSIS_TIMEOUT.
+func requestTextDetection(ctx context.Context, region, imageURL string) (selector.TextAnalysis, error) {
+	if analysisTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, analysisTimeout)
+		defer cancel()
+	}
+	return regionProvider(region).(selector.TextDetector).DetectText(ctx, imageURL)
+}
+
+// textIssue reports an image with more of its area covered by text than
+// TEXT_AREA_MAX.
+func textIssue(text selector.TextAnalysis, analysis selector.ImageAnalysis) string {
+	imageArea := float64(analysis.Metadata.Width * analysis.Metadata.Height)
+	if imageArea == 0 {
+		return ""
+	}
+	textArea := float64(0)
+	for _, line := range text.Lines {
+		textArea += float64(line.Rectangle.W * line.Rectangle.H)
+	}
+	if fraction := textArea / imageArea; fraction > textAreaMax {
+		return fmt.Sprintf("text %.2f%%", fraction*100)
+	}
+	return ""
+}
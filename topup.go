@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"contourguessr-subject-selector/selector"
+)
+
+// flickrTopUp is set by FLICKR_TOP_UP to search Flickr for more pictures
+// within a region's bounds once its manifest runs out short of the target.
+var flickrTopUp bool
+
+// flickrTopUpMax is the most search results looked at for each region.
+var flickrTopUpMax int
+
+// flickrSearchPageSize is the number of results requested per page, the most
+// flickr.photos.search allows.
+const flickrSearchPageSize = 250
+
+func loadTopUpConfig() {
+	flickrTopUp = envBool("FLICKR_TOP_UP", false)
+	if !flickrTopUp {
+		return
+	}
+	if regionBounds == nil {
+		log.Fatal("FLICKR_TOP_UP requires REGION_BOUNDS")
+	}
+	if selectionMode != "first" {
+		log.Fatal("FLICKR_TOP_UP requires SELECTION=first")
+	}
+	flickrTopUpMax = envInt("FLICKR_TOP_UP_MAX", 1000)
+	if flickrTopUpMax < 1 {
+		log.Fatal("invalid FLICKR_TOP_UP_MAX ", flickrTopUpMax)
+	}
+}
+
+// boundingBox returns the smallest box containing polygon, as the minimum
+// longitude, minimum latitude, maximum longitude and maximum latitude.
+func boundingBox(polygon [][2]float64) [4]float64 {
+	box := [4]float64{polygon[0][0], polygon[0][1], polygon[0][0], polygon[0][1]}
+	for _, p := range polygon[1:] {
+		box[0], box[1] = min(box[0], p[0]), min(box[1], p[1])
+		box[2], box[3] = max(box[2], p[0]), max(box[3], p[1])
+	}
+	return box
+}
+
+type flickrSearchResponse struct {
+	Stat    string `json:"stat"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Photos  struct {
+		Page  int `json:"page"`
+		Pages int `json:"pages"`
+		Photo []struct {
+			ID     string `json:"id"`
+			Owner  string `json:"owner"`
+			Secret string `json:"secret"`
+			Server string `json:"server"`
+			Title  string `json:"title"`
+		} `json:"photo"`
+	} `json:"photos"`
+}
+
+// flickrSearchSource returns a source over up to FLICKR_TOP_UP_MAX geotagged
+// photos taken within box, most interesting first, fetching each page of
+// results only once the previous one has been consumed.
+func flickrSearchSource(box [4]float64) manifestSource {
+	return func(yield func(selector.ManifestEntry) bool) error {
+		n := 0
+		for page := 1; ; page++ {
+			body, err := searchFlickr(box, page)
+			if err != nil {
+				return err
+			}
+			for _, photo := range body.Photos.Photo {
+				entry := selector.ManifestEntry{ID: photo.ID, Owner: photo.Owner, Secret: photo.Secret, Server: photo.Server, Title: photo.Title}
+				n++
+				if n > flickrTopUpMax || !yield(entry) {
+					return nil
+				}
+			}
+			if page >= body.Photos.Pages || len(body.Photos.Photo) == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+func searchFlickr(box [4]float64, page int) (flickrSearchResponse, error) {
+	bbox := make([]string, len(box))
+	for i, v := range box {
+		bbox[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	query := url.Values{
+		"method":         {"flickr.photos.search"},
+		"api_key":        {flickrAPIKey},
+		"bbox":           {fmt.Sprintf("%s,%s,%s,%s", bbox[0], bbox[1], bbox[2], bbox[3])},
+		"has_geo":        {"1"},
+		"content_type":   {"1"},
+		"media":          {"photos"},
+		"sort":           {"interestingness-desc"},
+		"per_page":       {strconv.Itoa(flickrSearchPageSize)},
+		"page":           {strconv.Itoa(page)},
+		"format":         {"json"},
+		"nojsoncallback": {"1"},
+	}
+	resp, err := flickrAPIGet(query)
+	if err != nil {
+		return flickrSearchResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return flickrSearchResponse{}, fmt.Errorf("Flickr API HTTP status %d", resp.StatusCode)
+	}
+
+	var body flickrSearchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return flickrSearchResponse{}, fmt.Errorf("decode Flickr API response: %w", err)
+	}
+	if body.Stat != "ok" {
+		return flickrSearchResponse{}, fmt.Errorf("Flickr API error %d: %s", body.Code, body.Message)
+	}
+	return body, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// completionWebhook is a URL that a CompletionEvent is POSTed to when each
+// region is done, set by COMPLETION_WEBHOOK.
+var completionWebhook string
+
+// webhookRetries is how many times a failed webhook request is retried, and
+// webhookRetryDelay the delay before the first retry, doubling after each.
+var webhookRetries = 2
+var webhookRetryDelay = time.Second
+
+// CompletionEvent is the payload of the completion webhook.
+type CompletionEvent struct {
+	Region  string `json:"region"`
+	OKCount int    `json:"okCount"`
+	Target  int    `json:"target"`
+	// Output is the path of the region's output file.
+	Output          string  `json:"output"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// notifyCompletion POSTs event to the completion webhook, if one is set. A
+// webhook that keeps failing is only logged, as downstream steps can always
+// be triggered by hand.
+func notifyCompletion(event CompletionEvent) {
+	if completionWebhook == "" {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		warnRegionf(event.Region, "Not calling COMPLETION_WEBHOOK: %v", err)
+		return
+	}
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		err = postWebhook(body)
+		if err == nil {
+			return
+		}
+		if attempt >= webhookRetries {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	warnRegionf(event.Region, "COMPLETION_WEBHOOK failed: %v", err)
+}
+
+func postWebhook(body []byte) error {
+	resp, err := httpClient.Post(completionWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}